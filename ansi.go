@@ -0,0 +1,130 @@
+// Copyright 2026 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmdtest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ansiModes are the valid values of TestSuite.ANSI and the "#ansi:" directive.
+var ansiModes = map[string]bool{"keep": true, "strip": true, "tokens": true}
+
+// ansiRegexp matches an ANSI escape sequence: a control sequence (CSI), an
+// operating system command (OSC) ended by BEL or ST, or another escape, such as
+// "\x1b7". The first group holds the parameters of a CSI sequence, and the
+// second its final byte.
+var ansiRegexp = regexp.MustCompile("\x1b\\[([0-?]*)[ -/]*([@-~])|\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|\x1b[0-~]")
+
+// handleANSI returns b with its ANSI escape sequences handled according to mode:
+// "strip" removes them, and "tokens" renders color and style sequences as
+// tokens like "<red>" and removes the others. Otherwise b is returned unchanged.
+func handleANSI(mode string, b []byte) []byte {
+	switch mode {
+	case "strip":
+		return ansiRegexp.ReplaceAll(b, nil)
+	case "tokens":
+		return ansiRegexp.ReplaceAllFunc(b, func(seq []byte) []byte {
+			m := ansiRegexp.FindSubmatch(seq)
+			if m[2] == nil || string(m[2]) != "m" {
+				return nil
+			}
+			return []byte(sgrTokens(string(m[1])))
+		})
+	default:
+		return b
+	}
+}
+
+// ansiColors are the names of the eight basic ANSI colors.
+var ansiColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// sgrTokens renders the parameters of an SGR (Select Graphic Rendition)
+// sequence, which sets colors and styles, as tokens. For example, "1;31" becomes
+// "<bold><red>", and "0" or "" becomes "</>", which ends all colors and styles.
+func sgrTokens(params string) string {
+	var buf strings.Builder
+	ps := strings.Split(params, ";")
+	for i := 0; i < len(ps); i++ {
+		n, err := strconv.Atoi(ps[i])
+		if ps[i] == "" {
+			n, err = 0, nil
+		}
+		if err != nil {
+			fmt.Fprintf(&buf, "<sgr %s>", ps[i])
+			continue
+		}
+		switch {
+		case n == 0:
+			buf.WriteString("</>")
+		case n == 1:
+			buf.WriteString("<bold>")
+		case n == 2:
+			buf.WriteString("<dim>")
+		case n == 3:
+			buf.WriteString("<italic>")
+		case n == 4:
+			buf.WriteString("<underline>")
+		case n == 7:
+			buf.WriteString("<reverse>")
+		case n == 22:
+			buf.WriteString("</bold>")
+		case n == 23:
+			buf.WriteString("</italic>")
+		case n == 24:
+			buf.WriteString("</underline>")
+		case n == 27:
+			buf.WriteString("</reverse>")
+		case n >= 30 && n <= 37:
+			fmt.Fprintf(&buf, "<%s>", ansiColors[n-30])
+		case n == 39:
+			buf.WriteString("</fg>")
+		case n >= 40 && n <= 47:
+			fmt.Fprintf(&buf, "<bg-%s>", ansiColors[n-40])
+		case n == 49:
+			buf.WriteString("</bg>")
+		case n >= 90 && n <= 97:
+			fmt.Fprintf(&buf, "<bright-%s>", ansiColors[n-90])
+		case n >= 100 && n <= 107:
+			fmt.Fprintf(&buf, "<bg-bright-%s>", ansiColors[n-100])
+		case (n == 38 || n == 48) && i+2 < len(ps) && ps[i+1] == "5":
+			// 256-color palette.
+			fmt.Fprintf(&buf, "<%scolor%s>", bgPrefix(n), ps[i+2])
+			i += 2
+		case (n == 38 || n == 48) && i+4 < len(ps) && ps[i+1] == "2":
+			// RGB color.
+			var rgb [3]int
+			for j := range rgb {
+				rgb[j], _ = strconv.Atoi(ps[i+2+j])
+			}
+			fmt.Fprintf(&buf, "<%s#%02x%02x%02x>", bgPrefix(n), rgb[0], rgb[1], rgb[2])
+			i += 4
+		default:
+			fmt.Fprintf(&buf, "<sgr %d>", n)
+		}
+	}
+	return buf.String()
+}
+
+// bgPrefix returns the prefix of the token for an extended color set by the SGR
+// parameter n: 38 for the foreground, or 48 for the background.
+func bgPrefix(n int) string {
+	if n == 48 {
+		return "bg-"
+	}
+	return ""
+}
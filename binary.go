@@ -0,0 +1,89 @@
+// Copyright 2026 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmdtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// isText reports whether b can be compared line by line as text: it must be
+// valid UTF-8 without NUL bytes. Other control characters, like backspace or
+// BEL, occur in the output of ordinary text tools, so they are allowed.
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
+
+// showBinary returns the lines that show b, output that is not text, in the
+// given format: "hex" or "" for a hex dump, or "hash" for its size and hash.
+func showBinary(format string, b []byte) []string {
+	if format == "hash" {
+		return []string{fmt.Sprintf("binary output: %d bytes, sha256 %x", len(b), sha256.Sum256(b))}
+	}
+	return splitLines(hex.Dump(b))
+}
+
+// parseHexDump returns the bytes in lines, a hex dump in the format of
+// hex.Dump. It reports false if lines are not such a dump.
+func parseHexDump(lines []string) ([]byte, bool) {
+	if len(lines) == 0 {
+		return nil, false
+	}
+	var b []byte
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, false
+		}
+		// Skip the offset, and stop at the characters.
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "|") {
+				break
+			}
+			c, err := hex.DecodeString(f)
+			if err != nil || len(c) != 1 {
+				return nil, false
+			}
+			b = append(b, c[0])
+		}
+	}
+	return b, true
+}
+
+// describeByteDiff describes the first difference between want and got.
+func describeByteDiff(want, got []byte) string {
+	n := len(want)
+	if len(got) < n {
+		n = len(got)
+	}
+	i := 0
+	for i < n && want[i] == got[i] {
+		i++
+	}
+	switch {
+	case i < n:
+		return fmt.Sprintf("first difference at byte offset %d (%#x): want %#02x, got %#02x", i, i, want[i], got[i])
+	case len(want) < len(got):
+		return fmt.Sprintf("output is longer than expected: want %d bytes, got %d", len(want), len(got))
+	case len(want) > len(got):
+		return fmt.Sprintf("output is shorter than expected: want %d bytes, got %d", len(want), len(got))
+	default:
+		return "the bytes are equal, but the dump differs"
+	}
+}
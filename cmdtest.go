@@ -37,18 +37,27 @@ package cmdtest
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -73,10 +82,93 @@ import (
 //
 // Syntax of a line beginning with '$': A sequence of space-separated words (no
 // quoting is supported). The first word is the command, the rest are its args.
+// The command may be preceded by words of the form NAME=VALUE, which set
+// environment variables for that command only. Since they are set in the
+// environment of the test process, RunParallel does not support them.
 // If the next-to-last word is '<', the last word is interpreted as a file and
 // becomes the standard input to the command. None of the built-in commands (see
 // below) support input redirection, but commands defined with Program do.
 //
+// Standard input can also be given on the command line itself, after one of the
+// following operators, which must be surrounded by spaces. Variables are expanded
+// in the text after the operator.
+//
+//	<<< TEXT         TEXT followed by a newline; if TEXT is enclosed in double
+//	                 quotes, it is a Go string literal, and no newline is added
+//	<<<hex HEX       the bytes encoded by HEX (spaces are ignored)
+//	<<<base64 DATA   the bytes encoded by DATA in standard base64
+//
+// Comment lines immediately before a case can hold directives, which configure
+// the case. A directive line looks like "#name: ARG". The directives are:
+//
+//	#name: NAME
+//	    Name the case. The name is used in error messages and as the name of
+//	    the case's subtest, instead of the line number of its first command.
+//	    It may contain letters, digits, '_', '-' and '.', but not only
+//	    digits, and must be unique within the file.
+//
+//	#expect: TEXT
+//	#send: TEXT
+//	    Add a step to the terminal script of the case. The script becomes the
+//	    input of the case's last command, which is normally defined with
+//	    TerminalProgram. See TerminalProgram for the meaning of the steps.
+//
+//	#compare: json
+//	    Compare the output of the case with the expected output as sequences
+//	    of JSON values, ignoring white space and the order of object keys.
+//	    Differences are reported by path within the values.
+//
+//	#compare: unordered
+//	    Compare the lines of output of the case with the expected lines as
+//	    multisets, ignoring their order, for commands whose output order is
+//	    not deterministic. Update mode writes the output in sorted order.
+//
+//	#compare: contains
+//	    Require the expected lines to appear in the output of the case in the
+//	    same order, but not necessarily next to each other. Other lines of
+//	    output are ignored. Update mode leaves the case alone, and reports an
+//	    error if the lines are missing, unless TestSuite.ForceUpdate is set.
+//
+//	#binary: hex
+//	#binary: hash
+//	    Choose how to show the output of the case if it is not text: that is,
+//	    if it is not valid UTF-8 or contains a NUL byte. With hex (the
+//	    default), the output is shown as a hex dump in the format of hex.Dump,
+//	    with the byte offset at the start of each line. With hash, it is shown
+//	    as its size and SHA-256 hash. Output that is text is shown as usual.
+//
+//	#ansi: keep
+//	#ansi: strip
+//	#ansi: tokens
+//	    Set how to handle ANSI escape sequences in the output of the case,
+//	    overriding TestSuite.ANSI.
+//
+//	#lineendings: keep
+//	#lineendings: strip
+//	#lineendings: crlf
+//	    Set how to treat carriage returns in the output of every case of the
+//	    file, overriding TestSuite.LineEndings. This directive is allowed only
+//	    before the first case.
+//
+//	#mustnot: REGEXP
+//	    Require that the regular expression REGEXP match no line of the
+//	    output of the case. A failure reports the matching line. A case may
+//	    have several of these negative assertions, and update mode keeps them.
+//
+//	#golden: FILE
+//	    Take the expected output of the case from FILE, a path relative to
+//	    the directory of the test file using '/' as the separator, instead of
+//	    from the test file, which must have no output for the case. Update
+//	    mode rewrites FILE, creating it if necessary; otherwise, FILE must
+//	    exist.
+//
+// A command line of the form "capture VAR COMMAND ARG ..." runs the command,
+// and instead of adding its output to the case's output, sets the environment
+// variable VAR to the output with surrounding white space removed. In the output
+// of later commands in the file, occurrences of the captured value are replaced
+// by "${VAR}". Since the variable is set in the environment of the test process,
+// RunParallel does not support capture.
+//
 // By default, commands are expected to succeed, and the test will fail
 // otherwise. However, commands that are expected to fail can be marked
 // with a " --> FAIL" suffix. The word FAIL may optionally be followed
@@ -85,41 +177,187 @@ import (
 // The cases of a test file are executed in order, starting in a freshly created
 // temporary directory. Execution of a file stops with the first case that
 // doesn't behave as expected, but other files in the suite will still run.
+// If IsolateCases is set, each case instead starts in its own fresh directory
+// and environment, so cases do not depend on one another.
 //
 // The built-in commands (initial contents of the Commands map) are:
 //
 //	cd DIR
 //	cat FILE
-//	mkdir DIR
+//	mkdir [-p] DIR
 //	setenv VAR VALUE
+//	unsetenv VAR
+//	env [NAME ...]
 //	echo ARG1 ARG2 ...
 //	fecho FILE ARG1 ARG2 ...
+//	rm [-r] FILE ...
+//	cp [-r] SRC DST
+//	mv SRC DST
+//	touch FILE ...
+//	chmod MODE FILE ...
+//	ln [-s] TARGET LINK
+//	exists [-not] FILE ...
+//	cmp FILE1 FILE2
+//	grep PATTERN FILE
+//	ls [-size] [-mode] [-hash] [DIR]
+//	tree [-size] [-mode] [-hash] [DIR]
+//	sleep DURATION
+//	waitfile FILE [TIMEOUT]
+//	waitport HOST:PORT [TIMEOUT]
+//	httpstub ROUTES
+//	httprequests
+//	json FILE [QUERY]
 //
 // These all have their usual Unix shell meaning, except for fecho, which writes its
-// arguments to a file (output redirection is not supported). All file and directory
-// arguments must refer to the current directory; that is, they cannot contain
-// slashes.
+// arguments to a file (output redirection is not supported), and mkdir, which
+// accepts a -p flag to create missing parents. They are implemented in Go, so
+// they behave the same on every platform; chmod accepts only an octal MODE. File
+// and directory arguments may be relative paths with '/' as the separator, or
+// absolute paths, but they must refer to something inside ROOTDIR.
+//
+// The commands exists, cmp and grep make assertions about files. They fail with
+// exit code 1 if the files are missing (or with -not, present), differ, or have
+// no lines matching PATTERN, respectively. The error of a failing cmp describes
+// the differences between the files; grep writes the matching lines.
+//
+// The env command writes the environment, sorted by name. Given NAME arguments,
+// it writes only those variables; a NAME ending in '*' matches a prefix.
+//
+// The commands ls and tree list a directory, or with tree, a directory tree, in
+// a format that is the same on every platform, so it can be compared with
+// expected output. The flags add the mode, size and content hash of each entry.
+// Modes are the exception: Windows has no Unix permission bits, so use -mode
+// only in tests that run on Unix.
+//
+// The command sleep pauses for DURATION, written like "100ms" or "2s". The
+// commands waitfile and waitport wait for a file to exist or for a TCP port to
+// accept connections, as when a server started by an earlier command is coming
+// up. They check every few milliseconds, and fail with exit code 1 after
+// TIMEOUT, or WaitTimeout if no TIMEOUT is given.
+//
+// The command httpstub starts a local HTTP server for the commands under test to
+// call, and sets the variable HTTPSTUB to its URL, such as
+// "http://127.0.0.1:34567". The server is stopped when the test file finishes.
+// Each line of the file ROUTES describes a response, as in
+//
+//	GET /items 200 items.json
+//	DELETE /items/1 204
+//
+// The fields are the request method, the URL path, the status code and,
+// optionally, a file holding the response body. Requests for other routes get
+// status 404. The command httprequests writes the requests that the server has
+// received since it started or since the last httprequests, one line per request
+// holding its method and URL, followed by the lines of its body, each prefixed
+// with "| ". The URL of the server is replaced by "${HTTPSTUB}" in output.
+// RunParallel does not support httpstub and httprequests.
+//
+// The command json writes the JSON value in FILE indented, with object keys in
+// sorted order, so that it can be compared with expected output. A QUERY selects
+// part of the value: it is a sequence of object keys, each preceded by '.', and
+// array indexes in square brackets, as in ".items[0].name".
 //
 // cmdtest does its own environment variable substitution, using the syntax
 // "${VAR}". Test execution inherits the full environment of the test binary
-// caller (typically, your shell). The environment variable ROOTDIR is set to
-// the temporary directory created to run the test file.
+// caller (typically, your shell), unless TestSuite.Env is set. The environment
+// variable ROOTDIR is set to the temporary directory created to run the test
+// file. A variable reference may supply a default, as in "${VAR:-default}",
+// or a message to fail with if the variable is unset or empty, as in
+// "${VAR:?message}". Write "$${VAR}" for the literal text "${VAR}".
+//
+// These read-only variables are also available:
+//
+//	TESTFILE  the absolute path of the test file
+//	CASELINE  the line number of the first command of the current case
+//	/         the path separator of the operating system
+//
+// Unless it is set in the environment, GOOS is the operating system, as in
+// runtime.GOOS.
 type TestSuite struct {
 	// If non-nil, this function is called for each test. It is passed the root
 	// directory after it has been made the current directory.
 	Setup func(string) error
 
+	// If non-nil, this function is called after the cases that ran in a root
+	// directory have finished, before the directory is removed. It is passed
+	// the root directory. It is not called if Setup failed.
+	Teardown func(rootDir string) error
+
+	// If non-nil, these functions are called by Run and RunParallel before and
+	// after the cases of each file run. They are passed the file's subtest and
+	// the name of the test file.
+	BeforeFile, AfterFile func(t *testing.T, filename string)
+
+	// If non-nil, these functions are called by Run and RunParallel before and
+	// after each case runs. They are passed the case's subtest, the name of the
+	// test file, and the name of the case's subtest (the case's name, or the
+	// line number of its first command). AfterCase can call t.Failed to learn
+	// whether the case failed.
+	BeforeCase, AfterCase func(t *testing.T, filename, caseName string)
+
 	// The commands that can be executed (that is, whose names can occur as the
 	// first word of a command line).
 	Commands map[string]CommandFunc
 
 	// If true, don't delete the temporary root directories for each test file,
-	// and print out their names for debugging.
+	// and log their names for debugging.
 	KeepRootDirs bool
 
+	// If true, don't delete the temporary root directory of a test that fails,
+	// and log its name with the test's other output.
+	KeepFailedRootDirs bool
+
+	// If non-empty, the temporary root directory of a test that fails is copied
+	// to a subdirectory of ArtifactDir named after the test, so that it can be
+	// inspected or archived later. Any previous contents of that subdirectory
+	// are removed.
+	ArtifactDir string
+
 	// If true, don't log while comparing.
 	DisableLogging bool
 
+	// If non-nil, commands run in a hermetic environment, instead of one inherited
+	// from the caller of the test binary. It contains only PATH (copied from the
+	// caller's environment), ROOTDIR, HOME and TMPDIR, which are set to the
+	// directories "home" and "tmp" in ROOTDIR, and the variables in Env. An entry
+	// of the form "NAME=VALUE" sets NAME to VALUE; an entry "NAME" copies NAME from
+	// the caller's environment, if it is set. On Windows, SYSTEMROOT is also
+	// copied, and USERPROFILE, TMP and TEMP are set like HOME and TMPDIR.
+	// Variables in test files are then expanded using this environment only.
+	// Env has no effect in parallel mode.
+	Env []string
+
+	// If true, run each test case in its own freshly created root directory,
+	// and restore the environment after each case. Setup is called once per
+	// case. A case selected with go test -run then runs without the cases before
+	// it. IsolateCases has no effect in parallel mode.
+	IsolateCases bool
+
+	// LineEndings says what to do with carriage returns in the output of cases
+	// before it is split into lines:
+	//
+	//	"keep"   keep them, so they end up in the lines (the default)
+	//	"strip"  replace each "\r\n" with "\n"
+	//	"crlf"   require every line to end in "\r\n", then strip as above
+	//
+	// A "#lineendings:" directive before the first case of a file overrides
+	// LineEndings for that file.
+	LineEndings string
+
+	// ANSI says what to do with ANSI escape sequences, which set colors and
+	// styles, in the output of cases:
+	//
+	//	"keep"    keep them (the default)
+	//	"strip"   remove them
+	//	"tokens"  render colors and styles as tokens like "<red>" and "</>",
+	//	          and remove other sequences
+	//
+	// An "#ansi:" directive overrides ANSI for a case.
+	ANSI string
+
+	// If true, update mode overwrites the expected output of cases compared
+	// with "#compare: contains", which it otherwise leaves alone.
+	ForceUpdate bool
+
 	files []*testFile
 }
 
@@ -128,17 +366,33 @@ type testFile struct {
 	filename string // full filename of the test file
 	cases    []*testCase
 	suffix   []string // non-output lines after last case
+	crlf     bool     // the file's lines end in "\r\n"
+	// How to treat line endings in the output of every case, from a
+	// "#lineendings:" directive before the first case; optional.
+	lineEndings string
 }
 
 type testCase struct {
 	before    []string // lines before the commands
 	startLine int      // line of first command
+	name      string   // from a "#name:" directive; optional
+	script    []string // terminal script, from "#expect:" and "#send:" directives
+	compare   string   // how to compare output, from a "#compare:" directive; optional
+	golden    string   // file holding the expected output, from a "#golden:" directive; optional
+	noGolden  bool     // the golden file does not exist yet
+	binary    string   // how to show binary output, from a "#binary:" directive; optional
+	ansi      string   // how to handle ANSI escapes, from an "#ansi:" directive; optional
+	// Negative assertions about the output, from "#mustnot:" directives.
+	mustNot []*regexp.Regexp
 	// The list of commands to execute.
 	commands []string
 
 	// The stdout and stderr, merged and split into lines.
 	gotOutput  []string // from execution
 	wantOutput []string // from file
+	gotBinary  []byte   // the output from execution, if it is not text
+
+	update bool // if true, write gotOutput instead of wantOutput
 }
 
 // CommandFunc is the signature of a command function. The function takes the
@@ -172,12 +426,31 @@ func Read(dir string) (*TestSuite, error) {
 	}
 	ts := &TestSuite{
 		Commands: map[string]CommandFunc{
-			"cat":    fixedArgBuiltin(1, catCmd),
-			"cd":     fixedArgBuiltin(1, cdCmd),
-			"echo":   echoCmd,
-			"fecho":  fechoCmd,
-			"mkdir":  fixedArgBuiltin(1, mkdirCmd),
-			"setenv": fixedArgBuiltin(2, setenvCmd),
+			"cat":          fixedArgBuiltin(1, catCmd),
+			"cd":           fixedArgBuiltin(1, cdCmd),
+			"chmod":        minArgBuiltin(2, chmodCmd),
+			"cmp":          fixedArgBuiltin(2, cmpCmd),
+			"cp":           minArgBuiltin(2, cpCmd),
+			"echo":         echoCmd,
+			"env":          minArgBuiltin(0, envCmd),
+			"exists":       minArgBuiltin(1, existsCmd),
+			"fecho":        fechoCmd,
+			"grep":         fixedArgBuiltin(2, grepCmd),
+			"httprequests": fixedArgBuiltin(0, httprequestsCmd),
+			"httpstub":     fixedArgBuiltin(1, httpstubCmd),
+			"json":         minArgBuiltin(1, jsonCmd),
+			"ln":           minArgBuiltin(2, lnCmd),
+			"ls":           minArgBuiltin(0, listBuiltin(false)),
+			"mkdir":        minArgBuiltin(1, mkdirCmd),
+			"mv":           fixedArgBuiltin(2, mvCmd),
+			"rm":           minArgBuiltin(1, rmCmd),
+			"setenv":       fixedArgBuiltin(2, setenvCmd),
+			"sleep":        fixedArgBuiltin(1, sleepCmd),
+			"touch":        minArgBuiltin(1, touchCmd),
+			"tree":         minArgBuiltin(0, listBuiltin(true)),
+			"unsetenv":     fixedArgBuiltin(1, unsetenvCmd),
+			"waitfile":     minArgBuiltin(1, waitfileCmd),
+			"waitport":     minArgBuiltin(1, waitportCmd),
 		},
 	}
 	for _, fn := range filenames {
@@ -202,13 +475,16 @@ func readFile(filename string) (*testFile, error) {
 	tf := &testFile{
 		filename: filename,
 	}
-	f, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	// Remember the line endings of the file, so update mode can preserve them.
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		tf.crlf = true
+	}
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	var tc *testCase
 	lineno := 0
 	var prefix []string
@@ -220,7 +496,9 @@ func readFile(filename string) (*testFile, error) {
 		switch state {
 		case beforeFirstCommand:
 			if isCommand {
-				tc = &testCase{startLine: lineno, before: prefix}
+				if tc, err = tf.newTestCase(lineno, prefix); err != nil {
+					return nil, fmt.Errorf("%s:%v", filename, err)
+				}
 				tc.addCommandLine(line)
 				state = inCommands
 			} else {
@@ -243,7 +521,9 @@ func readFile(filename string) (*testFile, error) {
 		case inOutput:
 			if isCommand { // A command marks the end of the output.
 				prefix = tf.addCase(tc)
-				tc = &testCase{startLine: lineno, before: prefix}
+				if tc, err = tf.newTestCase(lineno, prefix); err != nil {
+					return nil, fmt.Errorf("%s:%v", filename, err)
+				}
 				tc.addCommandLine(line)
 				state = inCommands
 			} else {
@@ -259,9 +539,177 @@ func readFile(filename string) (*testFile, error) {
 	if tc != nil {
 		tf.suffix = tf.addCase(tc)
 	}
+	names := map[string]bool{}
+	for _, tc := range tf.cases {
+		if tc.name == "" {
+			continue
+		}
+		if names[tc.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate case name %q", filename, tc.startLine, tc.name)
+		}
+		names[tc.name] = true
+	}
+	for _, tc := range tf.cases {
+		if tc.golden == "" {
+			continue
+		}
+		if len(tc.wantOutput) > 0 {
+			return nil, fmt.Errorf("%s:%d: case has both a golden file and output", filename, tc.startLine)
+		}
+		tc.wantOutput, tc.noGolden, err = readGolden(tf.goldenPath(tc))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, tc.startLine, err)
+		}
+	}
 	return tf, nil
 }
 
+// checkMustNot reports the lines of output of tc that match its negative
+// assertions. It returns the empty string if there are none.
+func (tc *testCase) checkMustNot() string {
+	var buf bytes.Buffer
+	for _, re := range tc.mustNot {
+		for j, line := range tc.gotOutput {
+			if re.MatchString(line) {
+				fmt.Fprintf(&buf, "output line %d matches #mustnot: %s\n  %s\n", j+1, re, line)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// goldenPath returns the path of the golden file of tc, which is relative to the
+// directory of tf.
+func (tf *testFile) goldenPath(tc *testCase) string {
+	return filepath.Join(filepath.Dir(tf.filename), filepath.FromSlash(tc.golden))
+}
+
+// readGolden returns the lines of a golden file, without trailing white space,
+// like the output of a case. As when reading a test file, a "\r" at the end of
+// a line is dropped, so golden files checked out with CRLF line endings still
+// match. A missing file is not an error, so that update mode
+// can create it; instead, readGolden reports whether the file is missing.
+func readGolden(file string) (lines []string, missing bool, err error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s := strings.TrimRight(string(data), " \t\r\n")
+	if s == "" {
+		return nil, false, nil
+	}
+	lines = strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines, false, nil
+}
+
+// directiveRegexp matches a directive: a comment line before the commands of a
+// case that configures the case. There is no space after the '#', so that prose
+// comments like "# name: ..." are not mistaken for directives.
+var directiveRegexp = regexp.MustCompile(`^#(name|expect|send|compare|golden|binary|lineendings|ansi|mustnot):(.*)$`)
+
+// lineEndingModes are the valid values of TestSuite.LineEndings and the
+// "#lineendings:" directive.
+var lineEndingModes = map[string]bool{"keep": true, "strip": true, "crlf": true}
+
+// lineEndingMode returns how to treat line endings in the output of the cases
+// of tf.
+func (tf *testFile) lineEndingMode() string {
+	if tf.lineEndings != "" {
+		return tf.lineEndings
+	}
+	return tf.suite.LineEndings
+}
+
+// caseNameRegexp matches valid case names. A name cannot be all digits, or it
+// could clash with the subtest name of an unnamed case, which is a line number.
+var caseNameRegexp = regexp.MustCompile(`^[\w.-]*[A-Za-z_.-][\w.-]*$`)
+
+// newTestCase returns a test case of tf whose first command is at startLine, and
+// which is preceded by the lines in before. It interprets the directives in
+// before, including those that configure tf.
+func (tf *testFile) newTestCase(startLine int, before []string) (*testCase, error) {
+	tc := &testCase{startLine: startLine, before: before}
+	for i, line := range before {
+		m := directiveRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		lineno := startLine - len(before) + i
+		arg := strings.TrimSpace(m[2])
+		switch m[1] {
+		case "name":
+			if tc.name != "" {
+				return nil, fmt.Errorf("%d: case already named %q", lineno, tc.name)
+			}
+			if !caseNameRegexp.MatchString(arg) {
+				return nil, fmt.Errorf("%d: bad case name %q (want letters, digits, '_', '-' or '.', not only digits)", lineno, arg)
+			}
+			tc.name = arg
+		case "expect", "send":
+			if _, err := parseScriptStep(m[1] + " " + arg); err != nil {
+				return nil, fmt.Errorf("%d: %v", lineno, err)
+			}
+			tc.script = append(tc.script, m[1]+" "+arg)
+		case "compare":
+			if tc.compare != "" {
+				return nil, fmt.Errorf("%d: case already compared as %s", lineno, tc.compare)
+			}
+			if arg != "json" && arg != "unordered" && arg != "contains" {
+				return nil, fmt.Errorf("%d: bad comparison %q (want json, unordered or contains)", lineno, arg)
+			}
+			tc.compare = arg
+		case "golden":
+			if tc.golden != "" {
+				return nil, fmt.Errorf("%d: case already has golden file %s", lineno, tc.golden)
+			}
+			if arg == "" || path.IsAbs(arg) || path.Clean(arg) != arg || arg == ".." || strings.HasPrefix(arg, "../") {
+				return nil, fmt.Errorf("%d: bad golden file %q (want a clean relative path using '/')", lineno, arg)
+			}
+			tc.golden = arg
+		case "binary":
+			if tc.binary != "" {
+				return nil, fmt.Errorf("%d: case already shows binary output as %s", lineno, tc.binary)
+			}
+			if arg != "hex" && arg != "hash" {
+				return nil, fmt.Errorf("%d: bad binary output format %q (want hex or hash)", lineno, arg)
+			}
+			tc.binary = arg
+		case "lineendings":
+			if len(tf.cases) > 0 {
+				return nil, fmt.Errorf("%d: #lineendings: directive must come before the first case", lineno)
+			}
+			if tf.lineEndings != "" {
+				return nil, fmt.Errorf("%d: line endings already set to %s", lineno, tf.lineEndings)
+			}
+			if !lineEndingModes[arg] {
+				return nil, fmt.Errorf("%d: bad line endings %q (want keep, strip or crlf)", lineno, arg)
+			}
+			tf.lineEndings = arg
+		case "ansi":
+			if tc.ansi != "" {
+				return nil, fmt.Errorf("%d: ANSI escape handling already set to %s", lineno, tc.ansi)
+			}
+			if !ansiModes[arg] {
+				return nil, fmt.Errorf("%d: bad ANSI escape handling %q (want keep, strip or tokens)", lineno, arg)
+			}
+			tc.ansi = arg
+		case "mustnot":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%d: bad negative assertion: %v", lineno, err)
+			}
+			tc.mustNot = append(tc.mustNot, re)
+		}
+	}
+	return tc, nil
+}
+
 func (tc *testCase) addCommandLine(line string) {
 	tc.commands = append(tc.commands, strings.TrimSpace(line[1:]))
 }
@@ -290,7 +738,10 @@ func (tf *testFile) addCase(tc *testCase) []string {
 }
 
 // Run runs the commands in each file in the test suite. Each file runs in a
-// separate subtest.
+// separate subtest, and each case within it in a nested subtest named by the
+// line number of its first command. Selecting a case with go test -run also
+// executes the cases before it in the same file (unless IsolateCases is set),
+// but only the selected cases are compared or updated.
 //
 // If update is false, it compares their output with the output in the file,
 // line by line.
@@ -320,35 +771,41 @@ func (ts *TestSuite) run(t *testing.T, update, parallel bool) {
 	}
 }
 
-// compare runs a subtest for each file in the test suite. See Run.
+// compare runs a subtest for each file in the test suite, and within it a
+// subtest for each case. See Run.
 func (ts *TestSuite) compare(t *testing.T, parallel bool) {
-	log := t.Logf
-	if ts.DisableLogging {
-		log = noopLogger
-	}
 	for _, tf := range ts.files {
 		tf := tf
 		t.Run(strings.TrimSuffix(tf.filename, ".ct"), func(t *testing.T) {
 			if parallel {
 				t.Parallel()
 			}
-			if s := tf.compare(log, parallel); s != "" {
-				t.Error(s)
-			}
+			tf.runSubtests(t, parallel, func(t *testing.T, tc *testCase) {
+				if s := tf.diff([]*testCase{tc}); s != "" {
+					t.Error(s)
+				}
+			})
 		})
 	}
 }
 
 var noopLogger = func(_ string, _ ...interface{}) {}
 
-func (tf *testFile) compare(log func(string, ...interface{}), parallel bool) string {
-	if err := tf.execute(log, parallel); err != nil {
-		return fmt.Sprintf("%v", err)
-	}
+// diff returns a description of the differences between the wanted and actual
+// output of cases, or the empty string if there are none.
+func (tf *testFile) diff(cases []*testCase) string {
 	buf := new(bytes.Buffer)
-	for _, c := range tf.cases {
-		if diff := cmp.Diff(c.wantOutput, c.gotOutput); diff != "" {
-			fmt.Fprintf(buf, "%s:%d: want=-, got=+\n", tf.filename, c.startLine)
+	for _, c := range cases {
+		if c.noGolden {
+			fmt.Fprintf(buf, "%s:%s: golden file %s not found\n", tf.filename, c.position(c.startLine), c.golden)
+			continue
+		}
+		if diff := c.diff(); diff != "" {
+			if c.golden != "" {
+				fmt.Fprintf(buf, "%s:%s: want=- (from %s), got=+\n", tf.filename, c.position(c.startLine), c.golden)
+			} else {
+				fmt.Fprintf(buf, "%s:%s: want=-, got=+\n", tf.filename, c.position(c.startLine))
+			}
 			c.writeCommands(buf)
 			fmt.Fprintf(buf, "%s\n", diff)
 		}
@@ -356,15 +813,93 @@ func (tf *testFile) compare(log func(string, ...interface{}), parallel bool) str
 	return buf.String()
 }
 
-// update runs a subtest for each file in the test suite, updating their output.
-// See Run.
+// diff returns a description of the differences between the wanted and actual
+// output of tc, or the empty string if there are none.
+func (tc *testCase) diff() string {
+	return tc.checkMustNot() + tc.diffOutput()
+}
+
+// diffOutput is like diff, but ignores the negative assertions of tc.
+func (tc *testCase) diffOutput() string {
+	switch tc.compare {
+	case "json":
+		return jsonDiff(tc.wantOutput, tc.gotOutput)
+	case "unordered":
+		return cmp.Diff(sortedLines(tc.wantOutput), sortedLines(tc.gotOutput))
+	case "contains":
+		return containsDiff(tc.wantOutput, tc.gotOutput)
+	default:
+		diff := cmp.Diff(tc.wantOutput, tc.gotOutput)
+		if diff != "" && tc.gotBinary != nil {
+			if want, ok := parseHexDump(tc.wantOutput); ok {
+				diff = fmt.Sprintf("%s\n%s", describeByteDiff(want, tc.gotBinary), diff)
+			}
+		}
+		return diff
+	}
+}
+
+// containsDiff reports the lines of want that do not appear in got, in order. It
+// returns the empty string if want is a subsequence of got.
+func containsDiff(want, got []string) string {
+	var missing []string
+	j := 0
+	for _, w := range want {
+		k := j
+		for k < len(got) && got[k] != w {
+			k++
+		}
+		if k == len(got) {
+			missing = append(missing, w)
+			continue
+		}
+		j = k + 1
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "lines missing from the output, in order:")
+	for _, m := range missing {
+		fmt.Fprintf(&buf, "- %s\n", m)
+	}
+	fmt.Fprintln(&buf, "output:")
+	for _, g := range got {
+		fmt.Fprintf(&buf, "  %s\n", g)
+	}
+	return buf.String()
+}
+
+// update runs a subtest for each file in the test suite, and within it a
+// subtest for each case, updating the output of the cases that ran. See Run.
 func (ts *TestSuite) update(t *testing.T, parallel bool) {
 	for _, tf := range ts.files {
+		tf := tf
 		t.Run(strings.TrimSuffix(tf.filename, ".ct"), func(t *testing.T) {
 			if parallel {
 				t.Parallel()
 			}
-			tmpfile, err := tf.updateToTemp(parallel)
+			selected := false
+			ok := tf.runSubtests(t, parallel, func(t *testing.T, tc *testCase) {
+				// Negative assertions are kept, so they must still hold.
+				if s := tc.checkMustNot(); s != "" {
+					t.Errorf("%s:%s:\n%s", tf.filename, tc.position(tc.startLine), s)
+				}
+				if tc.compare == "contains" && !ts.ForceUpdate {
+					// The expected lines were chosen by hand, so keep them.
+					if diff := tc.diffOutput(); diff != "" {
+						t.Errorf("%s:%s: not updating a case compared with contains; set ForceUpdate to overwrite it\n%s",
+							tf.filename, tc.position(tc.startLine), diff)
+					}
+					return
+				}
+				tc.update = true
+				selected = true
+			})
+			if !ok || !selected {
+				return
+			}
+			tmpfile, err := tf.writeToTemp()
 			if tmpfile != nil {
 				defer func() {
 					if err := tmpfile.Cleanup(); err != nil {
@@ -378,16 +913,56 @@ func (ts *TestSuite) update(t *testing.T, parallel bool) {
 			if err := tmpfile.CloseAtomicallyReplace(); err != nil {
 				t.Fatal(err)
 			}
+			for _, tc := range tf.cases {
+				if tc.update && tc.golden != "" {
+					if err := writeGolden(tf.goldenPath(tc), tc.updatedOutput()); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
 		})
 	}
 }
 
-// updateToTemp executes tf and writes the output to a temporary file.
-// It returns the temporary file.
-func (tf *testFile) updateToTemp(parallel bool) (f tempFile, err error) {
-	if err := tf.execute(noopLogger, parallel); err != nil {
-		return nil, err
+// updatedOutput returns the output that update mode writes for tc: the actual
+// output, sorted if tc is compared as unordered.
+func (tc *testCase) updatedOutput() []string {
+	if tc.compare == "unordered" {
+		return sortedLines(tc.gotOutput)
+	}
+	return tc.gotOutput
+}
+
+// sortedLines returns a sorted copy of lines.
+func sortedLines(lines []string) []string {
+	lines = append([]string(nil), lines...)
+	sort.Strings(lines)
+	return lines
+}
+
+// writeGolden atomically replaces the contents of the golden file with lines,
+// creating the file and its directory if necessary.
+func writeGolden(file string, lines []string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := createTempFile(file)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if cerr := f.Cleanup(); err == nil {
+			err = cerr
+		}
+	}()
+	if err := writeLines(f, lines); err != nil {
+		return err
+	}
+	return f.CloseAtomicallyReplace()
+}
+
+// writeToTemp writes tf to a temporary file, and returns the file.
+func (tf *testFile) writeToTemp() (f tempFile, err error) {
 	if f, err = createTempFile(tf.filename); err != nil {
 		return nil, err
 	}
@@ -398,48 +973,346 @@ func (tf *testFile) updateToTemp(parallel bool) (f tempFile, err error) {
 	return f, nil
 }
 
-func (tf *testFile) execute(log func(string, ...interface{}), parallel bool) error {
-	var rootDir string
+// runSubtests runs a subtest of t for each case of tf, calling check on the
+// case after executing it. Unless cases are isolated, a case depends on the
+// ones before it, so those are executed first even if go test -run did not
+// select them. runSubtests stops at the first case that fails to execute, and
+// reports whether all the cases it executed succeeded.
+func (tf *testFile) runSubtests(t *testing.T, parallel bool, check func(*testing.T, *testCase)) bool {
+	ts := tf.suite
+	if ts.BeforeFile != nil {
+		ts.BeforeFile(t, tf.filename)
+	}
+	if ts.AfterFile != nil {
+		defer ts.AfterFile(t, tf.filename)
+	}
+	var r *fileRun
+	closeRun := func(t *testing.T) {
+		if err := r.close(); err != nil {
+			t.Error(err)
+		}
+		if r.rootDir != "" {
+			tf.disposeRootDir(r.rootDir, t)
+		}
+		r = nil
+	}
+	defer func() {
+		if r != nil {
+			closeRun(t)
+		}
+	}()
+	ok := true
+	for _, tc := range tf.cases {
+		tc := tc
+		t.Run(tc.subtestName(), func(t *testing.T) {
+			log := t.Logf
+			if ts.DisableLogging {
+				log = noopLogger
+			}
+			if r == nil {
+				cases := tf.cases
+				if tf.isolated(parallel) {
+					cases = []*testCase{tc}
+				}
+				var err error
+				if r, err = tf.start(cases, parallel); err != nil {
+					ok = false
+					t.Fatal(err)
+				}
+				if tf.isolated(parallel) {
+					defer closeRun(t)
+				}
+			}
+			if ts.BeforeCase != nil {
+				ts.BeforeCase(t, tf.filename, tc.subtestName())
+			}
+			if ts.AfterCase != nil {
+				defer ts.AfterCase(t, tf.filename, tc.subtestName())
+			}
+			if err := r.runTo(tc, log); err != nil {
+				ok = false
+				t.Fatal(err)
+			}
+			check(t, tc)
+		})
+		if !ok {
+			break
+		}
+	}
+	return ok
+}
+
+// isolated reports whether each case of tf runs in its own root directory.
+func (tf *testFile) isolated(parallel bool) bool {
+	return tf.suite.IsolateCases && !parallel
+}
+
+// A fileRun is an execution of some of the cases of a test file, all in the
+// same root directory.
+type fileRun struct {
+	tf       *testFile
+	parallel bool
+	rootDir  string
+	testFile string      // absolute path of tf.filename
+	captures []capture   // in order of decreasing value length
+	pending  []*testCase // cases not yet executed
+	setUp    bool        // Setup succeeded, so Teardown must be called
+	cleanups []func()    // called in reverse order by close
+	stub     *stubServer // started by the httpstub command
+}
+
+// currentRun is the fileRun executing cases, for the built-in commands that keep
+// state for the rest of the run, like httpstub. Runs started by RunParallel
+// cannot share it, so it is nil during them.
+var currentRun *fileRun
+
+// currentFileRun returns currentRun, or an error if there is none because the
+// built-in command cmd is run by RunParallel.
+func currentFileRun(cmd string) (*fileRun, error) {
+	if currentRun == nil {
+		return nil, fmt.Errorf("%s: not supported by RunParallel", cmd)
+	}
+	return currentRun, nil
+}
+
+// A capture is the output of a command, saved in a variable.
+type capture struct {
+	name, value string
+}
+
+// start prepares to execute cases: unless parallel is true, it creates and
+// enters a new root directory. Then it calls the suite's Setup function.
+// Any changes the cases make to the environment are undone by close.
+func (tf *testFile) start(cases []*testCase, parallel bool) (*fileRun, error) {
+	r := &fileRun{tf: tf, parallel: parallel, pending: cases}
+	testFile, err := filepath.Abs(tf.filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tf.filename, err)
+	}
+	r.testFile = testFile
+	if le := tf.suite.LineEndings; le != "" && !lineEndingModes[le] {
+		return nil, fmt.Errorf("%s: bad TestSuite.LineEndings %q (want keep, strip or crlf)", tf.filename, le)
+	}
+	if a := tf.suite.ANSI; a != "" && !ansiModes[a] {
+		return nil, fmt.Errorf("%s: bad TestSuite.ANSI %q (want keep, strip or tokens)", tf.filename, a)
+	}
 	if !parallel {
-		var err error
-		rootDir, err = ioutil.TempDir("", "cmdtest")
+		r.cleanups = append(r.cleanups, snapshotEnv())
+		currentRun = r
+		r.cleanups = append(r.cleanups, func() { currentRun = nil })
+		rootDir, cleanup, err := tf.enterRootDir()
 		if err != nil {
-			return fmt.Errorf("%s: %v", tf.filename, err)
+			r.close()
+			return nil, fmt.Errorf("%s: %v", tf.filename, err)
+		}
+		r.rootDir = rootDir
+		r.cleanups = append(r.cleanups, cleanup)
+		if tf.suite.Env != nil {
+			if err := tf.suite.setHermeticEnv(rootDir); err != nil {
+				r.close()
+				return nil, fmt.Errorf("%s: %v", tf.filename, err)
+			}
+		}
+	}
+
+	if tf.suite.Setup != nil {
+		if err := tf.suite.Setup(r.rootDir); err != nil {
+			r.close()
+			return nil, fmt.Errorf("%s: calling Setup: %v", tf.filename, err)
+		}
+	}
+	r.setUp = true
+	return r, nil
+}
+
+// runTo executes the pending cases of r, up to and including tc. If tc is nil,
+// it executes all of them.
+func (r *fileRun) runTo(tc *testCase, log func(string, ...interface{})) error {
+	for len(r.pending) > 0 {
+		c := r.pending[0]
+		r.pending = r.pending[1:]
+		if err := c.execute(r, log); err != nil {
+			r.pending = nil
+			return fmt.Errorf("%s:%v", r.tf.filename, err) // no space after :, for line number
+		}
+		if c == tc {
+			break
+		}
+	}
+	return nil
+}
+
+// close calls the suite's Teardown function, and then undoes the effects of
+// start, except for creating the root directory. It returns the error from
+// Teardown.
+func (r *fileRun) close() error {
+	var err error
+	if r.setUp && r.tf.suite.Teardown != nil {
+		if terr := r.tf.suite.Teardown(r.rootDir); terr != nil {
+			err = fmt.Errorf("%s: calling Teardown: %v", r.tf.filename, terr)
 		}
-		if tf.suite.KeepRootDirs {
-			fmt.Printf("%s: test root directory: %s\n", tf.filename, rootDir)
+	}
+	r.setUp = false
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+	r.cleanups = nil
+	return err
+}
+
+// enterRootDir creates a temporary root directory, sets ROOTDIR to it and makes
+// it the current directory. The returned function undoes all of that, except
+// that it does not remove the directory.
+func (tf *testFile) enterRootDir() (rootDir string, cleanup func(), err error) {
+	rootDir, err = ioutil.TempDir("", "cmdtest")
+	if err != nil {
+		return "", nil, err
+	}
+	cwd, err := os.Getwd()
+	if err == nil {
+		err = os.Setenv("ROOTDIR", rootDir)
+	}
+	if err == nil {
+		err = os.Chdir(rootDir)
+	}
+	cleanup = func() {
+		_ = os.Chdir(cwd)
+		os.Unsetenv("ROOTDIR")
+	}
+	if err != nil {
+		cleanup()
+		os.RemoveAll(rootDir)
+		return "", nil, err
+	}
+	return rootDir, cleanup, nil
+}
+
+// disposeRootDir removes rootDir, which was used by test t, unless the suite
+// says to keep it, in which case it logs the location of the directory. If t
+// failed, the directory may also be copied to ArtifactDir.
+func (tf *testFile) disposeRootDir(rootDir string, t *testing.T) {
+	ts := tf.suite
+	if t.Failed() && ts.ArtifactDir != "" {
+		dst := filepath.Join(ts.ArtifactDir, filepath.FromSlash(t.Name()))
+		if err := os.RemoveAll(dst); err != nil {
+			t.Errorf("removing old artifacts: %v", err)
+		} else if err := copyDir(rootDir, dst); err != nil {
+			t.Errorf("copying root directory to artifacts: %v", err)
 		} else {
-			defer os.RemoveAll(rootDir)
+			t.Logf("root directory copied to %s", dst)
 		}
+	}
+	if ts.KeepRootDirs || (t.Failed() && ts.KeepFailedRootDirs) {
+		t.Logf("root directory kept at %s", rootDir)
+		return
+	}
+	os.RemoveAll(rootDir)
+}
 
-		if err := os.Setenv("ROOTDIR", rootDir); err != nil {
-			return fmt.Errorf("%s: %v", tf.filename, err)
+// copyDir copies the directory tree rooted at src to dst, which must not exist.
+// It preserves file modes and symbolic links.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-		defer os.Unsetenv("ROOTDIR")
-		cwd, err := os.Getwd()
+		rel, err := filepath.Rel(src, path)
 		if err != nil {
-			return fmt.Errorf("%s: %v", tf.filename, err)
+			return err
 		}
-
-		if err := os.Chdir(rootDir); err != nil {
-			return fmt.Errorf("%s: %v", tf.filename, err)
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
 		}
-		defer func() { _ = os.Chdir(cwd) }()
+	})
+}
+
+// copyFile copies the contents of the file src to a new file dst with the given
+// permissions.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	if tf.suite.Setup != nil {
-		if err := tf.suite.Setup(rootDir); err != nil {
-			return fmt.Errorf("%s: calling Setup: %v", tf.filename, err)
+// setHermeticEnv replaces the environment with one for running tests in
+// rootDir. See the documentation of TestSuite.Env.
+func (ts *TestSuite) setHermeticEnv(rootDir string) error {
+	home := filepath.Join(rootDir, "home")
+	tmp := filepath.Join(rootDir, "tmp")
+	env := map[string]string{
+		"ROOTDIR": rootDir,
+		"HOME":    home,
+		"TMPDIR":  tmp,
+	}
+	inherited := []string{"PATH"}
+	if runtime.GOOS == "windows" {
+		inherited = append(inherited, "SYSTEMROOT")
+		env["USERPROFILE"] = home
+		env["TMP"] = tmp
+		env["TEMP"] = tmp
+	}
+	for _, name := range inherited {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = v
 		}
 	}
-	for _, tc := range tf.cases {
-		if err := tc.execute(tf.suite, log, parallel); err != nil {
-			return fmt.Errorf("%s:%v", tf.filename, err) // no space after :, for line number
+	for _, e := range ts.Env {
+		if i := strings.IndexByte(e, '='); i >= 0 {
+			env[e[:i]] = e[i+1:]
+		} else if v, ok := os.LookupEnv(e); ok {
+			env[e] = v
+		}
+	}
+	for _, dir := range []string{home, tmp} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+	}
+	os.Clearenv()
+	for name, v := range env {
+		if err := os.Setenv(name, v); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// snapshotEnv records the current environment, and returns a function that
+// restores it.
+func snapshotEnv() (restore func()) {
+	env := os.Environ()
+	return func() {
+		os.Clearenv()
+		for _, kv := range env {
+			// On Windows, some variable names begin with '='.
+			if i := strings.Index(kv[1:], "=") + 1; i > 0 {
+				os.Setenv(kv[:i], kv[i+1:])
+			}
+		}
+	}
+}
+
 // Run the test case by executing the commands. The concatenated output from all commands
 // is saved in tc.gotOutput.
 // An error is returned if any of the following occur:
@@ -448,24 +1321,79 @@ func (tf *testFile) execute(log func(string, ...interface{}), parallel bool) err
 //   - A command that should fail with a particular error code instead failed
 //     with a different one.
 //   - A built-in command was called incorrectly.
-func (tc *testCase) execute(ts *TestSuite, log func(string, ...interface{}), parallel bool) error {
+func (tc *testCase) execute(r *fileRun, log func(string, ...interface{})) error {
+	ts := r.tf.suite
+	lookup := func(name string) (string, bool) {
+		switch name {
+		case "TESTFILE":
+			return r.testFile, true
+		case "CASELINE":
+			return strconv.Itoa(tc.startLine), true
+		case "GOOS":
+			if v, ok := os.LookupEnv("GOOS"); ok {
+				return v, true
+			}
+			return runtime.GOOS, true
+		case "/":
+			return string(filepath.Separator), true
+		default:
+			return os.LookupEnv(name)
+		}
+	}
 	tc.gotOutput = nil
+	tc.gotBinary = nil
 	var allout []byte
 	for i, cmd := range tc.commands {
 		cmd, wantFail, wantExitCode, err := parseCommand(cmd)
 		if err != nil {
-			return err
+			return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
 		}
-		_ = wantExitCode
-		args := strings.Fields(cmd)
-		for i := range args {
-			args[i], err = expandVariables(args[i], os.LookupEnv)
+		cmdWords, encoding, input, hasInput := cutHereString(cmd)
+		var stdin []byte
+		if hasInput {
+			if input, err = expandVariables(input, lookup); err == nil {
+				stdin, err = decodeHereString(encoding, input)
+			}
 			if err != nil {
-				return err
+				return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
+			}
+		}
+		args := strings.Fields(cmdWords)
+		for j := range args {
+			args[j], err = expandVariables(args[j], lookup)
+			if err != nil {
+				return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
 			}
 		}
 		log("$ %s", strings.Join(args, " "))
-		name := args[0]
+		var captureVar string
+		if len(args) > 0 && args[0] == "capture" {
+			if len(args) < 3 || !varNameRegexp.MatchString(args[1]) {
+				return fmt.Errorf("%s: usage: capture VAR COMMAND ARG ...", tc.position(tc.startLine+i))
+			}
+			if err := checkWritableVar(args[1]); err != nil {
+				return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
+			}
+			if r.parallel {
+				// Like NAME=VALUE prefixes, the variable would leak into other tests.
+				return fmt.Errorf("%s: capture is not supported by RunParallel", tc.position(tc.startLine+i))
+			}
+			captureVar = args[1]
+			args = args[2:]
+		}
+		var assignments []string
+		for len(args) > 0 && assignmentRegexp.MatchString(args[0]) {
+			assignments = append(assignments, args[0])
+			args = args[1:]
+		}
+		if len(assignments) > 0 && r.parallel {
+			// Other tests running at the same time would see the variables.
+			return fmt.Errorf("%s: NAME=VALUE prefixes are not supported by RunParallel", tc.position(tc.startLine+i))
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s: missing command", tc.position(tc.startLine+i))
+		}
+		name := args[0]
 		args = args[1:]
 		var infile string
 		if len(args) >= 2 && args[len(args)-2] == "<" {
@@ -474,33 +1402,84 @@ func (tc *testCase) execute(ts *TestSuite, log func(string, ...interface{}), par
 		}
 		f := ts.Commands[name]
 		if f == nil {
-			return fmt.Errorf("%d: no such command %q", tc.startLine+i, name)
+			return fmt.Errorf("%s: no such command %q", tc.position(tc.startLine+i), name)
+		}
+		if len(tc.script) > 0 && i == len(tc.commands)-1 {
+			// The terminal script is the input of the case's last command.
+			if hasInput || infile != "" {
+				return fmt.Errorf("%s: cannot redirect the input of a command with a terminal script", tc.position(tc.startLine+i))
+			}
+			hasInput = true
+			stdin = []byte(strings.Join(tc.script, "\n") + "\n")
+		}
+		if hasInput {
+			if infile != "" {
+				return fmt.Errorf("%s: cannot redirect input from both a file and the command line", tc.position(tc.startLine+i))
+			}
+			if infile, err = writeTempInput(stdin); err != nil {
+				return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
+			}
+		}
+		restoreEnv, err := setScopedEnv(assignments)
+		if err != nil {
+			return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
 		}
 		out, err := f(args, infile)
+		restoreEnv()
+		if hasInput {
+			os.Remove(infile)
+		}
 		log("%s\n", string(out))
-		allout = append(allout, out...)
+		if captureVar != "" {
+			value := strings.TrimSpace(string(out))
+			if err := os.Setenv(captureVar, value); err != nil {
+				return fmt.Errorf("%s: %v", tc.position(tc.startLine+i), err)
+			}
+			r.addCapture(captureVar, value)
+		} else {
+			allout = append(allout, r.scrubCaptures(out)...)
+		}
 		line := tc.startLine + i
 		if err == nil && wantFail {
-			return fmt.Errorf("%d: %q succeeded, but it was expected to fail", line, cmd)
+			return fmt.Errorf("%s: %q succeeded, but it was expected to fail", tc.position(line), cmd)
 		}
 		if err != nil && !wantFail {
-			return fmt.Errorf("%d: %q failed with %v", line, cmd, err)
+			return fmt.Errorf("%s: %q failed with %v", tc.position(line), cmd, err)
 		}
 		if err != nil && wantFail && wantExitCode != 0 {
 			gotExitCode, ok := extractExitCode(err)
 			if !ok {
-				return fmt.Errorf("%d: %q failed without an exit code, but one was expected", line, cmd)
+				return fmt.Errorf("%s: %q failed without an exit code, but one was expected", tc.position(line), cmd)
 			}
 			if gotExitCode != wantExitCode {
-				return fmt.Errorf("%d: %q failed with exit code %d, but %d was expected",
-					line, cmd, gotExitCode, wantExitCode)
+				return fmt.Errorf("%s: %q failed with exit code %d, but %d was expected",
+					tc.position(line), cmd, gotExitCode, wantExitCode)
 			}
 		}
 	}
 	if len(allout) > 0 {
-		if !parallel {
+		if !r.parallel {
 			allout = scrub(os.Getenv("ROOTDIR"), allout) // use Getenv because Setup could change ROOTDIR
 		}
+		ansi := tc.ansi
+		if ansi == "" {
+			ansi = ts.ANSI
+		}
+		allout = handleANSI(ansi, allout)
+		if !isText(allout) {
+			tc.gotBinary = allout
+			tc.gotOutput = showBinary(tc.binary, allout)
+			return nil
+		}
+		switch r.tf.lineEndingMode() {
+		case "crlf":
+			if i := findLF(allout); i >= 0 {
+				return fmt.Errorf("%s: output line %d ends in \"\\n\", not \"\\r\\n\"", tc.position(tc.startLine), i+1)
+			}
+			fallthrough
+		case "strip":
+			allout = bytes.Replace(allout, []byte("\r\n"), []byte("\n"), -1)
+		}
 		// Remove final whitespace.
 		s := strings.TrimRight(string(allout), " \t\n")
 		tc.gotOutput = strings.Split(s, "\n")
@@ -508,6 +1487,186 @@ func (tc *testCase) execute(ts *TestSuite, log func(string, ...interface{}), par
 	return nil
 }
 
+// findLF returns the index of the first line of b that ends in a bare "\n"
+// rather than "\r\n", or -1 if there is none.
+func findLF(b []byte) int {
+	for i, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if bytes.HasSuffix(line, []byte("\n")) && !bytes.HasSuffix(line, []byte("\r\n")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// subtestName returns the name of the subtest that runs tc: its name if it has
+// one, and otherwise the line number of its first command.
+func (tc *testCase) subtestName() string {
+	if tc.name != "" {
+		return tc.name
+	}
+	return strconv.Itoa(tc.startLine)
+}
+
+// position formats line, a line of tc, for error messages. It includes the name
+// of tc, if any.
+func (tc *testCase) position(line int) string {
+	if tc.name != "" {
+		return fmt.Sprintf("%d: case %q", line, tc.name)
+	}
+	return strconv.Itoa(line)
+}
+
+// varNameRegexp matches the name of an environment variable that can be set in a
+// test file.
+var varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// assignmentRegexp matches a word that assigns a value to an environment
+// variable, like "NAME=VALUE".
+var assignmentRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// addCapture records that the output of a command, value, was captured into the
+// variable name, so that the value can be scrubbed from later output.
+func (r *fileRun) addCapture(name, value string) {
+	for i, c := range r.captures {
+		if c.name == name {
+			r.captures = append(r.captures[:i], r.captures[i+1:]...)
+			break
+		}
+	}
+	if value == "" {
+		return
+	}
+	r.captures = append(r.captures, capture{name, value})
+	// Replace longer values first, in case one value contains another.
+	sort.SliceStable(r.captures, func(i, j int) bool {
+		return len(r.captures[i].value) > len(r.captures[j].value)
+	})
+}
+
+// scrubCaptures replaces the captured values in b with references to the
+// variables that hold them. A value is replaced only where it does not start or
+// end in the middle of a word, so that a captured "1" leaves "1021" alone.
+func (r *fileRun) scrubCaptures(b []byte) []byte {
+	if len(r.captures) == 0 {
+		return b
+	}
+	var out []byte
+	for i := 0; i < len(b); {
+		n := 0
+		for _, c := range r.captures {
+			end := i + len(c.value)
+			if bytes.HasPrefix(b[i:], []byte(c.value)) && atWordBoundary(b, i) && atWordBoundary(b, end) {
+				out = append(out, "${"+c.name+"}"...)
+				n = len(c.value)
+				break
+			}
+		}
+		if n == 0 {
+			out = append(out, b[i])
+			n = 1
+		}
+		i += n
+	}
+	return out
+}
+
+// atWordBoundary reports whether offset i of b is not inside a word, that is,
+// whether the bytes on either side of it are not both word characters.
+func atWordBoundary(b []byte, i int) bool {
+	return i == 0 || i == len(b) || !isWordByte(b[i-1]) || !isWordByte(b[i])
+}
+
+// isWordByte reports whether c is an ASCII letter, a digit or '_'.
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// setScopedEnv sets the environment variables in assignments, each of the form
+// "NAME=VALUE". It returns a function that restores their previous values.
+func setScopedEnv(assignments []string) (restore func(), err error) {
+	type prev struct {
+		name, value string
+		ok          bool
+	}
+	var prevs []prev
+	for _, a := range assignments {
+		i := strings.IndexByte(a, '=')
+		name := a[:i]
+		if err := checkWritableVar(name); err != nil {
+			return nil, err
+		}
+		value, ok := os.LookupEnv(name)
+		prevs = append(prevs, prev{name, value, ok})
+		os.Setenv(name, a[i+1:])
+	}
+	return func() {
+		// Restore in reverse, in case a variable was assigned more than once.
+		for i := len(prevs) - 1; i >= 0; i-- {
+			p := prevs[i]
+			if p.ok {
+				os.Setenv(p.name, p.value)
+			} else {
+				os.Unsetenv(p.name)
+			}
+		}
+	}, nil
+}
+
+// hereStringRegexp matches an operator that supplies standard input on the
+// command line.
+var hereStringRegexp = regexp.MustCompile(`(^|\s)<<<(hex|base64)?(\s|$)`)
+
+// cutHereString splits cmd around its first here-string operator, if any,
+// returning the part before the operator, the operator's encoding ("", "hex" or
+// "base64"), and the text after it.
+func cutHereString(cmd string) (before, encoding, text string, found bool) {
+	ixs := hereStringRegexp.FindStringSubmatchIndex(cmd)
+	if ixs == nil {
+		return cmd, "", "", false
+	}
+	if ixs[4] >= 0 {
+		encoding = cmd[ixs[4]:ixs[5]]
+	}
+	return cmd[:ixs[0]], encoding, strings.TrimSpace(cmd[ixs[1]:]), true
+}
+
+// decodeHereString returns the standard input described by the text after a
+// here-string operator with the given encoding.
+func decodeHereString(encoding, text string) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(strings.Join(strings.Fields(text), ""))
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad quoted input %s: %v", text, err)
+		}
+		return []byte(s), nil
+	}
+	return []byte(text + "\n"), nil
+}
+
+// writeTempInput writes data to a new temporary file, and returns the file's
+// name. The caller should remove the file.
+func writeTempInput(data []byte) (string, error) {
+	f, err := ioutil.TempFile("", "cmdtest-stdin")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
 func parseCommand(cmdline string) (cmd string, wantFail bool, wantExitCode int, err error) {
 	const failMarker = " --> FAIL"
 	i := strings.LastIndex(cmdline, failMarker)
@@ -549,6 +1708,202 @@ func extractExitCode(err error) (code int, ok bool) {
 	}
 }
 
+// TerminalProgram is like Program, but the executable runs with a new
+// pseudo-terminal as its standard input, output and error, so that it behaves as
+// it would when run interactively. TerminalProgram is supported only on Linux.
+//
+// If the command's input is redirected, the input is a script that drives the
+// terminal. Each line of the script is one of
+//
+//	expect TEXT   wait until TEXT appears in the output
+//	send TEXT     type TEXT, followed by a newline
+//
+// As with the "<<<" operator, TEXT may be a double-quoted Go string literal, in
+// which case no newline is added; for example, send "\x04" types Control-D.
+// Each expect waits for its text after the text matched by the previous one,
+// failing after ExpectTimeout.
+//
+// The command's output is a transcript of the session, including the input
+// echoed by the terminal, with "\r\n" replaced by "\n". After the script ends,
+// the command has ExpectTimeout to exit before it is killed.
+func TerminalProgram(path string) CommandFunc {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		panic(fmt.Sprintf("TerminalProgram(%q): %v", path, err))
+	}
+	return terminalProgram(abspath).run
+}
+
+// A terminalProgram is the absolute path of an executable run by
+// TerminalProgram.
+type terminalProgram string
+
+// run is the command function returned by TerminalProgram.
+func (p terminalProgram) run(args []string, inputFile string) ([]byte, error) {
+	var script []scriptStep
+	if inputFile != "" {
+		data, err := ioutil.ReadFile(inputFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range splitLines(string(data)) {
+			step, err := parseScriptStep(line)
+			if err != nil {
+				return nil, err
+			}
+			script = append(script, step)
+		}
+	}
+	return runInTerminal(exec.Command(string(p), args...), script)
+}
+
+// ExpectTimeout is how long an expect step of a TerminalProgram script waits for
+// its text.
+var ExpectTimeout = 10 * time.Second
+
+// A scriptStep is one step of a TerminalProgram script.
+type scriptStep struct {
+	send bool   // send text, rather than expecting it
+	text []byte // the text to send or expect
+}
+
+// parseScriptStep parses a line of a TerminalProgram script.
+func parseScriptStep(line string) (scriptStep, error) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		i = len(line)
+	}
+	op, text := line[:i], strings.TrimSpace(line[i:])
+	switch op {
+	case "send":
+		b, err := decodeHereString("", text)
+		return scriptStep{send: true, text: b}, err
+	case "expect":
+		if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+			s, err := strconv.Unquote(text)
+			if err != nil {
+				return scriptStep{}, fmt.Errorf("bad quoted text %s: %v", text, err)
+			}
+			text = s
+		}
+		if text == "" {
+			return scriptStep{}, errors.New("expect needs text")
+		}
+		return scriptStep{text: []byte(text)}, nil
+	default:
+		return scriptStep{}, fmt.Errorf("bad terminal script line %q (want \"expect TEXT\" or \"send TEXT\")", line)
+	}
+}
+
+// runInTerminal runs cmd with a new pseudo-terminal, following script.
+// See TerminalProgram.
+func runInTerminal(cmd *exec.Cmd, script []scriptStep) ([]byte, error) {
+	tty, err := startInTerminal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	// Read the terminal's output until the command exits. Signal each read on
+	// the changed channel, without blocking.
+	var (
+		mu      sync.Mutex
+		out     bytes.Buffer
+		changed = make(chan struct{}, 1)
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := tty.Read(buf)
+			mu.Lock()
+			out.Write(buf[:n])
+			mu.Unlock()
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			if err != nil {
+				// Once the command exits, Linux reports EIO rather than EOF.
+				return
+			}
+		}
+	}()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	transcript := func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return bytes.Replace(out.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+	}
+	var scriptErr error
+	matched := 0 // length of the output through the last match
+	for _, step := range script {
+		if step.send {
+			if _, err := tty.Write(step.text); err != nil {
+				scriptErr = err
+				break
+			}
+			continue
+		}
+		if scriptErr = expect(step.text, &mu, &out, &matched, changed, done); scriptErr != nil {
+			break
+		}
+	}
+	if scriptErr == nil {
+		// Give the command as long to exit as an expect step has to match, so
+		// that one still waiting for input cannot hang the test.
+		timer := time.NewTimer(ExpectTimeout)
+		defer timer.Stop()
+		select {
+		case err = <-exited:
+			<-done
+			return transcript(), err
+		case <-timer.C:
+			scriptErr = fmt.Errorf("timed out after %s waiting for the command to exit", ExpectTimeout)
+		}
+	}
+	_ = cmd.Process.Kill()
+	<-exited
+	<-done
+	return transcript(), scriptErr
+}
+
+// expect waits until text appears in out after the first *matched bytes, or the
+// output ends, or ExpectTimeout elapses. On success, it sets *matched to the end
+// of the match.
+func expect(text []byte, mu *sync.Mutex, out *bytes.Buffer, matched *int, changed, done <-chan struct{}) error {
+	timer := time.NewTimer(ExpectTimeout)
+	defer timer.Stop()
+	for {
+		mu.Lock()
+		i := bytes.Index(out.Bytes()[*matched:], text)
+		mu.Unlock()
+		if i >= 0 {
+			*matched += i + len(text)
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-done:
+			// Check once more, in case the last read completed the text.
+			mu.Lock()
+			i := bytes.Index(out.Bytes()[*matched:], text)
+			mu.Unlock()
+			if i >= 0 {
+				*matched += i + len(text)
+				return nil
+			}
+			return fmt.Errorf("output ended while expecting %q", text)
+		case <-timer.C:
+			return fmt.Errorf("timed out after %s expecting %q", ExpectTimeout, text)
+		}
+	}
+}
+
 // Program defines a command function that will run the executable at path using
 // the exec.Command package and return its combined output. If path is relative,
 // it is converted to an absolute path using the current directory at the time
@@ -651,7 +2006,7 @@ func execute(name string, args []string, infile string) ([]byte, error) {
 	return out, nil
 }
 
-var varRegexp = regexp.MustCompile(`\$\{([^${}]+)\}`)
+var varRegexp = regexp.MustCompile(`(\$?)\$\{([^${}]+)\}`)
 
 // expandVariables replaces variable references in s with their values. A reference
 // to a variable V looks like "${V}".
@@ -659,6 +2014,12 @@ var varRegexp = regexp.MustCompile(`\$\{([^${}]+)\}`)
 // is false if the variable doesn't exist.
 // expandVariables fails if s contains a reference to a non-existent variable.
 //
+// A reference may also have one of these forms:
+//
+//	${V:-DEFAULT}  the value of V, or DEFAULT if V doesn't exist or is empty
+//	${V:?MESSAGE}  the value of V; fail with MESSAGE if V doesn't exist or is empty
+//	$${V}          the literal text "${V}", without expansion
+//
 // This function differs from os.Expand in two ways. First, it does not expand $var,
 // only ${var}. The former is fragile. Second, an undefined variable results in an error,
 // rather than expanding to some string. We want to fail if a variable is undefined.
@@ -670,12 +2031,29 @@ func expandVariables(s string, lookup func(string) (string, bool)) (string, erro
 			sb.WriteString(s)
 			return sb.String(), nil
 		}
-		varName := s[ixs[2]:ixs[3]]
+		sb.WriteString(s[:ixs[0]])
+		ref := s[ixs[4]:ixs[5]]
+		if ixs[3] > ixs[2] { // escaped with "$$"
+			sb.WriteString("${" + ref + "}")
+			s = s[ixs[1]:]
+			continue
+		}
+		varName, op, arg := ref, "", ""
+		if i := strings.Index(ref, ":"); i >= 0 && i+1 < len(ref) && (ref[i+1] == '-' || ref[i+1] == '?') {
+			varName, op, arg = ref[:i], ref[i:i+2], ref[i+2:]
+		}
 		varVal, ok := lookup(varName)
-		if !ok {
+		switch {
+		case op == ":-" && varVal == "":
+			varVal = arg
+		case op == ":?" && varVal == "":
+			if arg == "" {
+				arg = "not set or empty"
+			}
+			return "", fmt.Errorf("variable %q: %s", varName, arg)
+		case op == "" && !ok:
 			return "", fmt.Errorf("variable %q not found", varName)
 		}
-		sb.WriteString(s[:ixs[0]])
 		sb.WriteString(varVal)
 		s = s[ixs[1]:]
 	}
@@ -693,6 +2071,9 @@ func scrub(rootDir string, b []byte) []byte {
 }
 
 func (tf *testFile) write(w io.Writer) error {
+	if tf.crlf {
+		w = crlfWriter{w}
+	}
 	for _, c := range tf.cases {
 		if err := c.write(w); err != nil {
 			return err
@@ -708,11 +2089,15 @@ func (tc *testCase) write(w io.Writer) error {
 	if err := tc.writeCommands(w); err != nil {
 		return err
 	}
-	out := tc.gotOutput
-	if out == nil {
-		out = tc.wantOutput
+	// The output of a case with a golden file is in that file.
+	if tc.golden == "" {
+		out := tc.wantOutput
+		if tc.update {
+			out = tc.updatedOutput()
+		}
+		return writeLines(w, out)
 	}
-	return writeLines(w, out)
+	return nil
 }
 
 func (tc *testCase) writeCommands(w io.Writer) error {
@@ -724,6 +2109,18 @@ func (tc *testCase) writeCommands(w io.Writer) error {
 	return nil
 }
 
+// crlfWriter writes to w, replacing each "\n" with "\r\n".
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 func writeLines(w io.Writer, lines []string) error {
 	for _, l := range lines {
 		if _, err := io.WriteString(w, l); err != nil {
@@ -748,17 +2145,35 @@ func fixedArgBuiltin(nargs int, f func([]string) ([]byte, error)) CommandFunc {
 	}
 }
 
+func minArgBuiltin(nargs int, f func([]string) ([]byte, error)) CommandFunc {
+	return func(args []string, inputFile string) ([]byte, error) {
+		if len(args) < nargs {
+			return nil, fmt.Errorf("need at least %d arguments", nargs)
+		}
+		if inputFile != "" {
+			return nil, errors.New("input redirection not supported")
+		}
+		return f(args)
+	}
+}
+
+// cutFlag reports whether the first of args is flag, and returns the remaining
+// args.
+func cutFlag(args []string, flag string) (bool, []string) {
+	if len(args) > 0 && args[0] == flag {
+		return true, args[1:]
+	}
+	return false, args
+}
+
 // cd DIR
 // change directory
 func cdCmd(args []string) ([]byte, error) {
-	if err := checkPath(args[0]); err != nil {
-		return nil, err
-	}
-	cwd, err := os.Getwd()
+	dir, err := checkPath(args[0])
 	if err != nil {
 		return nil, err
 	}
-	return nil, os.Chdir(filepath.Join(cwd, args[0]))
+	return nil, os.Chdir(dir)
 }
 
 // echo ARG1 ARG2 ...
@@ -788,22 +2203,24 @@ func fechoCmd(args []string, inputFile string) ([]byte, error) {
 	if inputFile != "" {
 		return nil, errors.New("input redirection not supported")
 	}
-	if err := checkPath(args[0]); err != nil {
+	file, err := checkPath(args[0])
+	if err != nil {
 		return nil, err
 	}
 	s := strings.Join(args[1:], " ")
 	s = strings.Replace(s, "\\n", "\n", -1)
 	s += "\n"
-	return nil, ioutil.WriteFile(args[0], []byte(s), 0600)
+	return nil, ioutil.WriteFile(file, []byte(s), 0600)
 }
 
 // cat FILE
 // copy file to stdout
 func catCmd(args []string) ([]byte, error) {
-	if err := checkPath(args[0]); err != nil {
+	file, err := checkPath(args[0])
+	if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(args[0])
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
@@ -816,28 +2233,569 @@ func catCmd(args []string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// mkdir DIR
-// create directory
+// mkdir [-p] DIR
+// create directory, or with -p, directory and any missing parents
 func mkdirCmd(args []string) ([]byte, error) {
-	if err := checkPath(args[0]); err != nil {
+	parents, args := cutFlag(args, "-p")
+	if len(args) != 1 {
+		return nil, errors.New("need exactly 1 directory")
+	}
+	dir, err := checkPath(args[0])
+	if err != nil {
 		return nil, err
 	}
-	return nil, os.Mkdir(args[0], 0700)
+	if parents {
+		return nil, os.MkdirAll(dir, 0700)
+	}
+	return nil, os.Mkdir(dir, 0700)
 }
 
 // setenv VAR VALUE
 // set environment variable
 func setenvCmd(args []string) ([]byte, error) {
+	if err := checkWritableVar(args[0]); err != nil {
+		return nil, err
+	}
 	return nil, os.Setenv(args[0], args[1])
 }
 
-func checkPath(path string) error {
-	if strings.ContainsRune(path, '/') || strings.ContainsRune(path, '\\') {
-		return fmt.Errorf("argument must be in the current directory (%q has a '/')", path)
+// unsetenv VAR
+// unset environment variable
+func unsetenvCmd(args []string) ([]byte, error) {
+	if err := checkWritableVar(args[0]); err != nil {
+		return nil, err
+	}
+	return nil, os.Unsetenv(args[0])
+}
+
+// checkWritableVar returns an error if name is one of the read-only variables
+// provided by cmdtest.
+func checkWritableVar(name string) error {
+	switch name {
+	case "TESTFILE", "CASELINE", "/":
+		return fmt.Errorf("variable %q is read-only", name)
 	}
 	return nil
 }
 
+// env [NAME ...]
+// write environment variables to stdout as NAME=VALUE lines, sorted by name
+//
+// If NAMEs are given, only those variables are written. A NAME ending in '*'
+// stands for all variables beginning with the part before the '*'.
+func envCmd(args []string) ([]byte, error) {
+	var lines []string
+	for _, kv := range os.Environ() {
+		name := kv
+		if i := strings.Index(kv[1:], "=") + 1; i > 0 {
+			name = kv[:i]
+		}
+		if len(args) == 0 || matchesAnyName(name, args) {
+			lines = append(lines, kv)
+		}
+	}
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, l := range lines {
+		fmt.Fprintln(&buf, l)
+	}
+	return buf.Bytes(), nil
+}
+
+// matchesAnyName reports whether name is one of names, or begins with the
+// prefix of a name in names that ends in '*'.
+func matchesAnyName(name string, names []string) bool {
+	for _, n := range names {
+		if n == name || (strings.HasSuffix(n, "*") && strings.HasPrefix(name, n[:len(n)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// rm [-r] FILE ...
+// remove files, or with -r, directory trees
+func rmCmd(args []string) ([]byte, error) {
+	recursive, args := cutFlag(args, "-r")
+	if len(args) == 0 {
+		return nil, errors.New("need at least 1 file")
+	}
+	args, err := checkPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range args {
+		if !recursive {
+			if err := os.Remove(a); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Unlike rm -r, RemoveAll succeeds if a doesn't exist.
+		if _, err := os.Lstat(a); err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(a); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// cp [-r] SRC DST
+// copy a file, or with -r, a directory tree
+//
+// If DST is an existing directory, SRC is copied into it.
+func cpCmd(args []string) ([]byte, error) {
+	recursive, args := cutFlag(args, "-r")
+	if len(args) != 2 {
+		return nil, errors.New("need exactly 2 files")
+	}
+	args, err := checkPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	src, dst := args[0], intoDir(args[0], args[1])
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if !recursive {
+			return nil, fmt.Errorf("%s is a directory (not copied)", src)
+		}
+		return nil, copyDir(src, dst)
+	}
+	return nil, copyFile(src, dst, info.Mode().Perm())
+}
+
+// mv SRC DST
+// move or rename a file or directory
+//
+// If DST is an existing directory, SRC is moved into it.
+func mvCmd(args []string) ([]byte, error) {
+	args, err := checkPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	return nil, os.Rename(args[0], intoDir(args[0], args[1]))
+}
+
+// intoDir returns the destination for copying or moving src to dst: if dst is
+// a directory, the result is inside it.
+func intoDir(src, dst string) string {
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		return filepath.Join(dst, filepath.Base(src))
+	}
+	return dst
+}
+
+// touch FILE ...
+// create files, or update their modification times
+func touchCmd(args []string) ([]byte, error) {
+	args, err := checkPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, a := range args {
+		f, err := os.OpenFile(a, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		if err := os.Chtimes(a, now, now); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// chmod MODE FILE ...
+// change file permissions; MODE is octal
+//
+// On Windows, only the owner's write bit has an effect: it controls whether
+// the file is read-only.
+func chmodCmd(args []string) ([]byte, error) {
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("bad mode %q: want octal permission bits", args[0])
+	}
+	files, err := checkPaths(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range files {
+		if err := os.Chmod(a, os.FileMode(mode)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// ln [-s] TARGET LINK
+// create a hard link, or with -s, a symbolic link
+func lnCmd(args []string) ([]byte, error) {
+	symbolic, args := cutFlag(args, "-s")
+	if len(args) != 2 {
+		return nil, errors.New("need exactly 2 files")
+	}
+	target, link := args[0], args[1]
+	if symbolic && !path.IsAbs(target) {
+		// The target of a relative symbolic link is relative to the link's
+		// directory, so that's where it must stay inside the root.
+		target = path.Join(path.Dir(link), target)
+	}
+	if _, err := checkPaths([]string{target, link}); err != nil {
+		return nil, err
+	}
+	if symbolic {
+		return nil, os.Symlink(filepath.FromSlash(args[0]), filepath.FromSlash(link))
+	}
+	return nil, os.Link(filepath.FromSlash(target), filepath.FromSlash(link))
+}
+
+// exists [-not] FILE ...
+// fail unless all the files exist, or with -not, unless none of them do
+func existsCmd(args []string) ([]byte, error) {
+	not, args := cutFlag(args, "-not")
+	if len(args) == 0 {
+		return nil, errors.New("need at least 1 file")
+	}
+	files, err := checkPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		_, err := os.Lstat(f)
+		switch {
+		case err != nil && !os.IsNotExist(err):
+			return nil, err
+		case err != nil && !not:
+			return nil, &ExitCodeErr{Msg: fmt.Sprintf("%s does not exist", args[i]), Code: 1}
+		case err == nil && not:
+			return nil, &ExitCodeErr{Msg: fmt.Sprintf("%s exists", args[i]), Code: 1}
+		}
+	}
+	return nil, nil
+}
+
+// cmp FILE1 FILE2
+// fail if the files differ, describing the differences between their lines in
+// the error
+func cmpCmd(args []string) ([]byte, error) {
+	files, err := checkPaths(args)
+	if err != nil {
+		return nil, err
+	}
+	var lines [2][]string
+	for i, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		lines[i] = splitLines(string(data))
+	}
+	if diff := cmp.Diff(lines[0], lines[1]); diff != "" {
+		msg := fmt.Sprintf("%s and %s differ (-%[1]s +%[2]s):\n%s", args[0], args[1], strings.TrimRight(diff, "\n"))
+		return nil, &ExitCodeErr{Msg: msg, Code: 1}
+	}
+	return nil, nil
+}
+
+// grep PATTERN FILE
+// write the lines of FILE that match the regular expression PATTERN to stdout,
+// and fail if there are none
+//
+// PATTERN has the syntax of the regexp package.
+func grepCmd(args []string) ([]byte, error) {
+	re, err := regexp.Compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	file, err := checkPath(args[1])
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, line := range splitLines(string(data)) {
+		if re.MatchString(line) {
+			fmt.Fprintln(&buf, line)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil, &ExitCodeErr{Msg: fmt.Sprintf("no match for %q in %s", args[0], args[1]), Code: 1}
+	}
+	return buf.Bytes(), nil
+}
+
+// ls [-size] [-mode] [-hash] [DIR]
+// tree [-size] [-mode] [-hash] [DIR]
+// list the contents of DIR, or the current directory
+//
+// ls lists only the entries of DIR, while tree lists everything beneath it. Each
+// line holds a path relative to DIR, using '/' as the separator, with a '/'
+// appended for directories and " -> TARGET" for symbolic links. The lines are
+// in the order of filepath.Walk: depth first, with the entries of each directory
+// sorted by name, so a directory's contents come right after it. The flags add
+// columns before the path, in this order: -mode adds the file mode and
+// permissions (as formatted by os.FileMode), -size the size in bytes, and -hash
+// the first 16 hex digits of the SHA-256 hash of the contents. Directories and
+// links have "-" for size and hash. The modes reported on Windows differ from
+// those on Unix, so -mode is not portable.
+func listBuiltin(recursive bool) func([]string) ([]byte, error) {
+	return func(args []string) ([]byte, error) {
+		var size, mode, hash bool
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			switch args[0] {
+			case "-size":
+				size = true
+			case "-mode":
+				mode = true
+			case "-hash":
+				hash = true
+			default:
+				return nil, fmt.Errorf("unknown flag %q", args[0])
+			}
+			args = args[1:]
+		}
+		if len(args) > 1 {
+			return nil, errors.New("need at most 1 directory")
+		}
+		dir := "."
+		if len(args) == 1 {
+			dir = args[0]
+		}
+		dir, err := checkPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == dir {
+				return nil
+			}
+			var cols []string
+			if mode {
+				cols = append(cols, info.Mode().String())
+			}
+			if size {
+				if info.Mode().IsRegular() {
+					cols = append(cols, strconv.FormatInt(info.Size(), 10))
+				} else {
+					cols = append(cols, "-")
+				}
+			}
+			if hash {
+				h := "-"
+				if info.Mode().IsRegular() {
+					if h, err = hashFile(path); err != nil {
+						return err
+					}
+				}
+				cols = append(cols, h)
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			switch {
+			case info.IsDir():
+				name += "/"
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				name += " -> " + filepath.ToSlash(target)
+			}
+			fmt.Fprintln(&buf, strings.Join(append(cols, name), " "))
+			if info.IsDir() && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// hashFile returns the first 16 hex digits of the SHA-256 hash of the contents of
+// file.
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// WaitTimeout is how long the waitfile and waitport built-in commands wait when
+// they are not given a timeout.
+var WaitTimeout = 10 * time.Second
+
+// waitPollInterval is how often waitfile and waitport check their condition.
+const waitPollInterval = 10 * time.Millisecond
+
+// sleep DURATION
+// pause for DURATION, which has the syntax of time.ParseDuration
+func sleepCmd(args []string) ([]byte, error) {
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(d)
+	return nil, nil
+}
+
+// waitfile FILE [TIMEOUT]
+// wait until FILE exists, failing after TIMEOUT
+func waitfileCmd(args []string) ([]byte, error) {
+	file, err := checkPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return nil, waitFor(args[1:], args[0], func(time.Duration) error {
+		_, err := os.Stat(file)
+		return err
+	})
+}
+
+// waitport HOST:PORT [TIMEOUT]
+// wait until a TCP connection to HOST:PORT succeeds, failing after TIMEOUT
+func waitportCmd(args []string) ([]byte, error) {
+	addr := args[0]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	return nil, waitFor(args[1:], addr, func(left time.Duration) error {
+		// Give up on a single attempt after a second, so that a dropped
+		// connection is retried, but not after the overall deadline.
+		d := net.Dialer{Timeout: time.Second, Deadline: time.Now().Add(left)}
+		conn, err := d.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// waitFor calls check, with the time left before the deadline, until it
+// succeeds. It gives up after the timeout in args, or WaitTimeout if args is
+// empty, and returns an error naming what it waited for, the time it waited and
+// the last error from check.
+func waitFor(args []string, what string, check func(left time.Duration) error) error {
+	timeout := WaitTimeout
+	switch len(args) {
+	case 0:
+	case 1:
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		timeout = d
+	default:
+		return errors.New("too many arguments")
+	}
+	start := time.Now()
+	for {
+		err := check(timeout - time.Since(start))
+		if err == nil {
+			return nil
+		}
+		elapsed := time.Since(start)
+		if elapsed >= timeout {
+			return &ExitCodeErr{
+				Msg:  fmt.Sprintf("gave up waiting for %s after %s: %v", what, elapsed.Round(time.Millisecond), err),
+				Code: 1,
+			}
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// splitLines splits s into lines. A final newline does not begin a new line.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// checkPaths calls checkPath on each of paths, and returns the results.
+func checkPaths(paths []string) ([]string, error) {
+	var res []string
+	for _, p := range paths {
+		p, err := checkPath(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// checkPath checks that path, an argument to a built-in command, refers to a
+// file inside ROOTDIR, or inside the current directory if ROOTDIR is not set.
+// Relative paths may contain directories, and must use '/' as a separator.
+// checkPath returns path converted to use the OS separator.
+func checkPath(path string) (string, error) {
+	p := filepath.FromSlash(path)
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	root := os.Getenv("ROOTDIR")
+	if root == "" {
+		root = cwd
+	}
+	// Compare both the paths as given and with symbolic links resolved, because
+	// the root directory may be reached through a link (as on macOS, where /tmp
+	// is a link to /private/tmp).
+	ok := false
+	if filepath.IsAbs(p) {
+		ok = isWithin(root, p) || isWithin(evalSymlinks(root), p)
+	} else {
+		ok = isWithin(root, filepath.Join(cwd, p)) || isWithin(evalSymlinks(root), filepath.Join(evalSymlinks(cwd), p))
+	}
+	if !ok {
+		return "", fmt.Errorf("argument %q is outside the root directory", path)
+	}
+	return p, nil
+}
+
+// isWithin reports whether path is dir or is inside it. Both must be absolute.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalSymlinks returns path with symbolic links resolved, or path itself if
+// that fails.
+func evalSymlinks(path string) string {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		return p
+	}
+	return path
+}
+
 // tempFile represents a temporary file.
 type tempFile interface {
 	io.Writer
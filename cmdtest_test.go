@@ -15,11 +15,12 @@
 package cmdtest
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -28,6 +29,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/renameio"
@@ -58,8 +60,9 @@ func echoStdin() int {
 func TestMain(m *testing.M) {
 	ret := m.Run()
 	// Clean up the echo-stdin binary if we can. (No big deal if we can't.)
+	// Subprocesses started by runTestSubprocess leave it for their parent.
 	cwd, err := os.Getwd()
-	if err == nil {
+	if err == nil && os.Getenv("CMDTEST_SUBPROCESS") == "" {
 		name := "echo-stdin"
 		if runtime.GOOS == "windows" {
 			name += ".exe"
@@ -121,21 +124,6 @@ func TestRead(t *testing.T) {
 
 }
 
-// compareReturningError is similar to compare, but it returns
-// errors/differences in an error.
-func (ts *TestSuite) compareReturningError(parallel bool) error {
-	var ss []string
-	for _, tf := range ts.files {
-		if s := tf.compare(noopLogger, parallel); s != "" {
-			ss = append(ss, s)
-		}
-	}
-	if len(ss) > 0 {
-		return errors.New(strings.Join(ss, "\n"))
-	}
-	return nil
-}
-
 func TestCompare(t *testing.T) {
 	once.Do(setup)
 	ts := mustReadTestSuite(t, "good")
@@ -148,21 +136,15 @@ func TestCompare(t *testing.T) {
 	// Since the output of cmp.Diff is unstable, we search for regexps we expect
 	// to find there, rather than checking an exact match.
 	t.Run("bad", func(t *testing.T) {
-		ts = mustReadTestSuite(t, "bad")
-		ts.Commands["echo-stdin"] = Program("echo-stdin")
-		ts.Commands["code17"] = func([]string, string) ([]byte, error) {
-			return nil, fmt.Errorf("wrapping: %w", &ExitCodeErr{Msg: "failed", Code: 17})
-		}
-		ts.Commands["inprocess99"] = InProcessProgram("inprocess99", func() int { return 99 })
-
-		err := ts.compareReturningError(false)
+		out, err := runSuiteSubprocess(filepath.Join("testdata", "bad"))
 		if err == nil {
 			t.Fatal("got nil, want error")
 		}
-		got := err.Error()
+		got := string(out)
 		wants := []string{
 			`testdata.bad.bad-output\.ct:\d: want=-, got=+`,
 			`testdata.bad.bad-output\.ct:\d: want=-, got=+`,
+			`testdata.bad.bad-name\.ct:\d: case "wrong": want=-, got=+`,
 			`testdata.bad.bad-fail-1\.ct:\d: "echo" succeeded, but it was expected to fail`,
 			`testdata.bad.bad-fail-2\.ct:\d: "cd foo" failed with chdir`,
 			`testdata.bad.bad-fail-3\.ct:\d: "cd foo bar" failed with need exactly`,
@@ -196,6 +178,157 @@ func TestCompare(t *testing.T) {
 	})
 }
 
+func TestReadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, contents, want string
+	}{
+		{"bad-name", "#name: a b\n$ echo\n", `1: bad case name "a b"`},
+		{"digit-name", "#name: 7\n$ echo\n", `1: bad case name "7"`},
+		{"two-names", "#name: a\n#name: b\n$ echo\n", `2: case already named "a"`},
+		{"duplicate-name", "#name: a\n$ echo\n\n#name: a\n$ echo\n", `5: duplicate case name "a"`},
+		{"late-lineendings", "$ echo\n\n#lineendings: strip\n$ echo\n", "3: #lineendings: directive must come before the first case"},
+		{"bad-lineendings", "#lineendings: preserve\n$ echo\n", `1: bad line endings "preserve"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "test.ct")
+			if err := ioutil.WriteFile(filename, []byte(test.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readFile(filename)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	ts := mustReadTestSuite(t, "builtins")
+	ts.Run(t, false)
+	if v, ok := os.LookupEnv("CT_A"); ok {
+		t.Errorf("CT_A=%q leaked out of the test file", v)
+	}
+}
+
+func TestWaitport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if _, err := waitportCmd([]string{addr, "1s"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, err = waitportCmd([]string{addr, "30ms"})
+	if err == nil || !strings.HasPrefix(err.Error(), "gave up waiting for "+addr+" after ") {
+		t.Errorf("got %v, want timeout error", err)
+	}
+}
+
+func TestScrubCaptures(t *testing.T) {
+	r := &fileRun{}
+	r.addCapture("N", "1")
+	r.addCapture("ID", "ab-1")
+	r.addCapture("SEP", "::")
+	r.addCapture("EMPTY", "")
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"1", "${N}"},
+		{"build 1021 ok", "build 1021 ok"},
+		{"1 of 1.1 x1 1_", "${N} of ${N}.${N} x1 1_"},
+		{"ab-1 ab-12 xab-1 ab-1-2", "${ID} ab-12 xab-${N} ${ID}-2"},
+		{"a::b:::c", "a${SEP}b${SEP}:c"},
+	} {
+		if got := string(r.scrubCaptures([]byte(test.in))); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+
+	// A new capture replaces an old one with the same name.
+	r.addCapture("ID", "xyz")
+	if got, want := string(r.scrubCaptures([]byte("ab-1 xyz"))), "ab-${N} ${ID}"; got != want {
+		t.Errorf("after recapture, got %q, want %q", got, want)
+	}
+}
+
+func TestCmpCmd(t *testing.T) {
+	defer snapshotEnv()()
+	root := t.TempDir()
+	os.Setenv("ROOTDIR", root)
+	one, two := filepath.Join(root, "one"), filepath.Join(root, "two")
+	for file, contents := range map[string]string{one: "a\nb\nc\n", two: "a\nb\nC\n"} {
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cmpCmd([]string{one, one}); err != nil {
+		t.Errorf("same file: got %v, want nil", err)
+	}
+	// The output of cmp.Diff is unstable, so look for the changed lines only.
+	_, err := cmpCmd([]string{one, two})
+	if code, ok := extractExitCode(err); !ok || code != 1 {
+		t.Fatalf("got %v, want exit code 1", err)
+	}
+	if !strings.Contains(err.Error(), `"c"`) || !strings.Contains(err.Error(), `"C"`) {
+		t.Errorf("got %v, want the changed lines", err)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	restore := snapshotEnv()
+	defer restore()
+	root := t.TempDir()
+	os.Setenv("ROOTDIR", root)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		in, want string // want == "" means an error
+	}{
+		{"f", "f"},
+		{"a/b/c", filepath.FromSlash("a/b/c")},
+		{"..", ".."},
+		{"../sub/../f", filepath.FromSlash("../sub/../f")},
+		{"../..", ""},
+		{"../../f", ""},
+		{filepath.Join(root, "f"), filepath.Join(root, "f")},
+		{filepath.Dir(root), ""},
+	} {
+		got, err := checkPath(test.in)
+		if err != nil {
+			got = ""
+		}
+		if got != test.want {
+			t.Errorf("checkPath(%q) = %q, %v; want %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestReadNames(t *testing.T) {
+	ts := mustReadTestSuite(t, "names")
+	var got []string
+	for _, tc := range ts.files[0].cases {
+		got = append(got, tc.subtestName())
+	}
+	// The comment "# name: ..." is not a directive.
+	want := []string{"first", "7"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("want=-, got=+\n%s", diff)
+	}
+	ts.Run(t, false)
+}
+
 func TestExpandVariables(t *testing.T) {
 	lookup := func(name string) (string, bool) {
 		switch name {
@@ -203,6 +336,8 @@ func TestExpandVariables(t *testing.T) {
 			return "1", true
 		case "B_C":
 			return "234", true
+		case "E":
+			return "", true
 		default:
 			return "", false
 		}
@@ -215,6 +350,14 @@ func TestExpandVariables(t *testing.T) {
 		{"${A}${B_C}", "1234"},
 		{" x${A}y  ${B_C}z ", " x1y  234z "},
 		{" ${A${B_C}", " ${A234"},
+		{"${C:-dflt}", "dflt"},
+		{"${A:-dflt}", "1"},
+		{"${E:-}x", "x"},
+		{"${E:-dflt}", "dflt"},
+		{"${A:?msg}", "1"},
+		{"$${A}", "${A}"},
+		{"$$${A}", "$${A}"},
+		{"$${C}-${A}", "${C}-1"},
 	} {
 		got, err := expandVariables(test.in, lookup)
 		if err != nil {
@@ -230,20 +373,31 @@ func TestExpandVariables(t *testing.T) {
 	if _, err := expandVariables("x${C}y", lookup); err == nil {
 		t.Error("got nil, want error")
 	}
+	// So is an unknown or empty variable with ":?".
+	for _, in := range []string{"${C:?oops}", "${E:?oops}"} {
+		_, err := expandVariables(in, lookup)
+		if err == nil || !strings.Contains(err.Error(), "oops") {
+			t.Errorf("%q: got %v, want error containing \"oops\"", in, err)
+		}
+	}
 }
 
-func TestUpdateToTemp(t *testing.T) {
+func TestUpdateGood(t *testing.T) {
 	once.Do(setup)
 	for _, dir := range []string{"good", "good-without-output"} {
-		ts := mustReadTestSuite(t, dir)
-		ts.Commands["echo-stdin"] = Program("echo-stdin")
-		ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
-		f, err := ts.files[0].updateToTemp(false)
-		defer f.Cleanup()
+		// Update a copy of the suite.
+		tmp := filepath.Join(t.TempDir(), dir)
+		if err := copyDir(filepath.Join("testdata", dir), tmp); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := Read(tmp)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if diff := diffFiles(t, "testdata/good/good.ct", f.Name()); diff != "" {
+		ts.Commands["echo-stdin"] = Program("echo-stdin")
+		ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
+		ts.update(t, false)
+		if diff := diffFiles(t, ts.files[0].filename, "testdata/good/good.ct"); diff != "" {
 			t.Errorf("%s: %s", dir, diff)
 		}
 	}
@@ -268,6 +422,331 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestGolden(t *testing.T) {
+	ts := mustReadTestSuite(t, "golden")
+	ts.Run(t, false)
+
+	// Update a copy of the suite, where the golden file is out of date.
+	dir := t.TempDir()
+	if err := copyDir(filepath.Join("testdata", "golden"), dir); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join(dir, "out", "big.txt")
+	if err := ioutil.WriteFile(golden, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runSuiteSubprocess(dir)
+	if err == nil || !strings.Contains(string(out), "want=- (from out/big.txt)") {
+		t.Errorf("got %v, want a diff naming the golden file\n%s", err, out)
+	}
+	ts, err = Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.update(t, false)
+	for _, name := range []string{"golden.ct", filepath.Join("out", "big.txt")} {
+		if diff := diffFiles(t, filepath.Join(dir, name), filepath.Join("testdata", "golden", name)); diff != "" {
+			t.Errorf("%s: %s", name, diff)
+		}
+	}
+
+	// A golden file with CRLF line endings matches, like a test file would.
+	data, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(golden, []byte(strings.Replace(string(data), "\n", "\r\n", -1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runSuiteSubprocess(dir); err != nil {
+		t.Errorf("CRLF golden file: %v\n%s", err, out)
+	}
+
+	// A missing golden file is an error, except in update mode.
+	if err := os.RemoveAll(filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runSuiteSubprocess(dir)
+	if err == nil || !strings.Contains(string(out), "golden file out/big.txt not found") {
+		t.Errorf("got %v, want an error about the missing golden file\n%s", err, out)
+	}
+	ts, err = Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.update(t, false)
+	if diff := diffFiles(t, golden, filepath.Join("testdata", "golden", "out", "big.txt")); diff != "" {
+		t.Errorf("after update: %s", diff)
+	}
+}
+
+func TestGoldenErrors(t *testing.T) {
+	for _, test := range []struct {
+		contents, want string
+	}{
+		{"#golden: ../x\n$ echo\n", `bad golden file "../x"`},
+		{"#golden: /x\n$ echo\n", `bad golden file "/x"`},
+		{"#golden: a/./x\n$ echo\n", `bad golden file "a/./x"`},
+		{"#golden: x\n#golden: y\n$ echo\n", "already has golden file x"},
+		{"#golden: x\n$ echo a\na\n", "case has both a golden file and output"},
+	} {
+		file := filepath.Join(t.TempDir(), "test.ct")
+		if err := ioutil.WriteFile(file, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readFile(file)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want error containing %q", test.contents, err, test.want)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	ts := mustReadTestSuite(t, "binary")
+	ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
+	ts.Run(t, false)
+}
+
+func TestIsText(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want bool
+	}{
+		{"", true},
+		{"plain\ttext\r\n", true},
+		{"\x1b[1mbold\x1b[0m", true},
+		{"back\bspace, bell\a, form feed\f, DEL\x7f", true},
+		{"héllo", true},
+		{"nul\x00", false},
+		{"\xff", false},
+	} {
+		if got := isText([]byte(test.in)); got != test.want {
+			t.Errorf("%q: got %t, want %t", test.in, got, test.want)
+		}
+	}
+}
+
+func TestBinaryDiff(t *testing.T) {
+	for _, test := range []struct {
+		want, got string
+		wantDiff  string
+	}{
+		{"0123456789abcdef\x00xyz", "0123456789abcdef\x00xYz", "first difference at byte offset 18 (0x12): want 0x79, got 0x59"},
+		{"\x00ab", "\x00abc", "output is longer than expected: want 3 bytes, got 4"},
+		{"\x00abc", "\x00ab", "output is shorter than expected: want 4 bytes, got 3"},
+	} {
+		tc := &testCase{
+			wantOutput: showBinary("hex", []byte(test.want)),
+			gotOutput:  showBinary("hex", []byte(test.got)),
+			gotBinary:  []byte(test.got),
+		}
+		if diff := tc.diff(); !strings.HasPrefix(diff, test.wantDiff+"\n") {
+			t.Errorf("%q, %q: got diff\n%s\nwant it to begin with %q", test.want, test.got, diff, test.wantDiff)
+		}
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	echoCRLF := func(args []string, _ string) ([]byte, error) {
+		return []byte(strings.Join(args, "\r\n") + "\r\n"), nil
+	}
+	ts := mustReadTestSuite(t, "lineendings")
+	ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
+	ts.Commands["echocrlf"] = echoCRLF
+	ts.Run(t, false)
+
+	// Update a copy of the CRLF file.
+	dir := t.TempDir()
+	ct := filepath.Join(dir, "crlf.ct")
+	if err := copyFile(filepath.Join("testdata", "lineendings", "crlf.ct"), ct, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Commands["echocrlf"] = echoCRLF
+	ts.update(t, false)
+	if diff := diffFiles(t, ct, filepath.Join("testdata", "lineendings", "crlf.ct")); diff != "" {
+		t.Error(diff)
+	}
+
+	for _, test := range []struct {
+		suite, contents, want string
+	}{
+		{"", "#lineendings: crlf\n$ echo a\na\n", `output line 1 ends in "\n", not "\r\n"`},
+		{"crlf", "$ echocrlf a\n$ echo b\na\nb\n", `output line 2 ends in "\n", not "\r\n"`},
+		{"strip", "$ echocrlf a\na\n", ""},
+		{"keep", "$ echocrlf a\na\n", "want=-, got=+"},
+		{"", "$ echocrlf a\na\n", "want=-, got=+"},
+		{"other", "$ echo a\na\n", `bad TestSuite.LineEndings "other"`},
+	} {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, "test.ct"), []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := runSuiteSubprocess(dir, "CMDTEST_LINE_ENDINGS="+test.suite)
+		if (test.want == "") != (err == nil) || !strings.Contains(string(out), test.want) {
+			t.Errorf("%q, %q: got %v, want %q\n%s", test.suite, test.contents, err, test.want, out)
+		}
+	}
+}
+
+func TestANSI(t *testing.T) {
+	ts := mustReadTestSuite(t, "ansi")
+	ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
+	ts.ANSI = "strip"
+	ts.Run(t, false)
+}
+
+func TestSGRTokens(t *testing.T) {
+	for _, test := range []struct {
+		params, want string
+	}{
+		{"", "</>"},
+		{"0", "</>"},
+		{"1;4;7", "<bold><underline><reverse>"},
+		{"22;23;24;27", "</bold></italic></underline></reverse>"},
+		{"32;44", "<green><bg-blue>"},
+		{"97;107", "<bright-white><bg-bright-white>"},
+		{"39;49", "</fg></bg>"},
+		{"38;5;12;48;5;0", "<color12><bg-color0>"},
+		{"38;2;1;2;3", "<#010203>"},
+		{"38;2;1", "<sgr 38><dim><bold>"},
+		{"5;x", "<sgr 5><sgr x>"},
+	} {
+		if got := sgrTokens(test.params); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.params, got, test.want)
+		}
+	}
+}
+
+func TestUnordered(t *testing.T) {
+	ts := mustReadTestSuite(t, "unordered")
+	ts.Run(t, false)
+
+	// A missing line is reported, and update mode writes sorted output.
+	dir := t.TempDir()
+	ct := filepath.Join(dir, "unordered.ct")
+	if err := ioutil.WriteFile(ct, []byte("#compare: unordered\n$ echo b\n$ echo a\n$ echo b\na\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runSuiteSubprocess(dir)
+	if err == nil || strings.Count(string(out), `"b"`) != 2 {
+		t.Errorf("got %v, want a diff adding b\n%s", err, out)
+	}
+	ts, err = Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.update(t, false)
+	got, err := ioutil.ReadFile(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#compare: unordered\n$ echo b\n$ echo a\n$ echo b\na\nb\nb\n"; string(got) != want {
+		t.Errorf("after update, got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestContains(t *testing.T) {
+	if os.Getenv("CMDTEST_SUBPROCESS") == "contains" {
+		ts, err := Read(os.Getenv("CMDTEST_CONTAINS_DIR"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.update(t, false)
+		return
+	}
+	ts := mustReadTestSuite(t, "contains")
+	ts.Run(t, false)
+
+	dir := t.TempDir()
+	ct := filepath.Join(dir, "contains.ct")
+	const contents = "#compare: contains\n$ echo a\n$ echo b\nb\nc\n"
+	if err := ioutil.WriteFile(ct, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runSuiteSubprocess(dir)
+	if err == nil || !regexp.MustCompile(`in order:\s+- c\s+output:\s+a\s+b\n`).Match(out) {
+		t.Errorf("got %v, want a diff reporting c as missing\n%s", err, out)
+	}
+	ts, err = Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update mode refuses to overwrite the case, in a subprocess because it fails.
+	out, err = runTestSubprocess("contains", "TestContains", "CMDTEST_CONTAINS_DIR="+dir)
+	if err == nil || !strings.Contains(string(out), "not updating a case compared with contains") {
+		t.Errorf("got %v, want update to refuse\n%s", err, out)
+	}
+	got, err := ioutil.ReadFile(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != contents {
+		t.Errorf("after refused update, got\n%s\nwant\n%s", got, contents)
+	}
+
+	ts.ForceUpdate = true
+	ts.update(t, false)
+	got, err = ioutil.ReadFile(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#compare: contains\n$ echo a\n$ echo b\na\nb\n"; string(got) != want {
+		t.Errorf("after forced update, got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMustNot(t *testing.T) {
+	ts := mustReadTestSuite(t, "mustnot")
+	ts.Run(t, false)
+
+	dir := t.TempDir()
+	ct := filepath.Join(dir, "mustnot.ct")
+	write := func(contents string) {
+		t.Helper()
+		if err := ioutil.WriteFile(ct, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("#mustnot: sec(ret)\n$ echo the secret is x\nthe secret is x\n")
+	out, err := runSuiteSubprocess(dir)
+	want := regexp.MustCompile(`output line 1 matches #mustnot: sec\(ret\)\s+the secret is x\n`)
+	if err == nil || !want.Match(out) {
+		t.Errorf("got %v, want output matching %q\n%s", err, want, out)
+	}
+
+	// Line numbers are in the order of the output, even if it is unordered.
+	write("#compare: unordered\n#mustnot: b\n$ echo b\n$ echo a\na\nb\n")
+	out, err = runSuiteSubprocess(dir)
+	if err == nil || !strings.Contains(string(out), "output line 1 matches #mustnot: b") {
+		t.Errorf("got %v, want output naming line 1\n%s", err, out)
+	}
+
+	// Update mode keeps negative assertions.
+	write("#mustnot: secret\n$ echo new\nold\n")
+	ts, err = Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.update(t, false)
+	got, err := ioutil.ReadFile(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#mustnot: secret\n$ echo new\nnew\n"; string(got) != want {
+		t.Errorf("after update, got\n%s\nwant\n%s", got, want)
+	}
+
+	write("$ echo a\n\n#mustnot: (\n$ echo b\n")
+	if _, err := Read(dir); err == nil || !strings.Contains(err.Error(), ":3: bad negative assertion") {
+		t.Errorf("got %v, want bad negative assertion error", err)
+	}
+}
+
 func TestParseCommand(t *testing.T) {
 	for _, test := range []struct {
 		cmdline  string
@@ -314,9 +793,401 @@ func TestParseCommand(t *testing.T) {
 	}
 }
 
+func TestIsolateCases(t *testing.T) {
+	ts := mustReadTestSuite(t, "isolate")
+	ts.IsolateCases = true
+	ts.Run(t, false)
+	if v, ok := os.LookupEnv("ISOLATED"); ok {
+		t.Errorf("ISOLATED=%q leaked out of the test file", v)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	for _, isolate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("isolate=%t", isolate), func(t *testing.T) {
+			var events []string
+			record := func(format string, args ...interface{}) {
+				events = append(events, fmt.Sprintf(format, args...))
+			}
+			ts := mustReadTestSuite(t, "parallel")
+			ts.IsolateCases = isolate
+			ts.Setup = func(string) error {
+				record("Setup")
+				return nil
+			}
+			ts.Teardown = func(rootDir string) error {
+				if _, err := os.Stat(rootDir); err != nil {
+					t.Errorf("Teardown: %v", err)
+				}
+				record("Teardown")
+				return nil
+			}
+			ts.BeforeFile = func(_ *testing.T, filename string) { record("BeforeFile %s", filepath.Base(filename)) }
+			ts.AfterFile = func(_ *testing.T, filename string) { record("AfterFile %s", filepath.Base(filename)) }
+			ts.BeforeCase = func(_ *testing.T, _, name string) { record("BeforeCase %s", name) }
+			ts.AfterCase = func(_ *testing.T, _, name string) { record("AfterCase %s", name) }
+			ts.Run(t, false)
+
+			var want []string
+			for _, file := range []struct {
+				name  string
+				lines []int
+			}{
+				{"par1.ct", []int{1, 5}},
+				{"par2.ct", []int{1, 4}},
+			} {
+				want = append(want, "BeforeFile "+file.name, "Setup")
+				for i, line := range file.lines {
+					if i > 0 && isolate {
+						want = append(want, "Teardown", "Setup")
+					}
+					want = append(want, fmt.Sprintf("BeforeCase %d", line), fmt.Sprintf("AfterCase %d", line))
+				}
+				want = append(want, "Teardown", "AfterFile "+file.name)
+			}
+			if diff := cmp.Diff(want, events); diff != "" {
+				t.Errorf("events: want=-, got=+\n%s", diff)
+			}
+		})
+	}
+}
+
+// runTestSubprocess runs the test binary in a subprocess with the given test
+// pattern, setting the environment variable CMDTEST_SUBPROCESS to name, and
+// returns its combined output. The test selected by pattern should check the
+// variable to decide what to do. Each element of env, of the form NAME=VALUE,
+// is added to the environment of the subprocess.
+func runTestSubprocess(name, pattern string, env ...string) ([]byte, error) {
+	cmd := exec.Command(os.Args[0], "-test.v", "-test.run="+pattern)
+	cmd.Env = append(append(os.Environ(), "CMDTEST_SUBPROCESS="+name), env...)
+	return cmd.CombinedOutput()
+}
+
+// runSuiteSubprocess runs the test suite in dir with Run in a subprocess, so
+// that its failures do not fail the calling test, and returns the combined
+// output of the subprocess. The elements of env are passed to
+// runTestSubprocess.
+func runSuiteSubprocess(dir string, env ...string) ([]byte, error) {
+	return runTestSubprocess("suite", "TestSuiteSubprocess", append(env, "CMDTEST_SUITE_DIR="+dir)...)
+}
+
+// TestSuiteSubprocess runs a test suite on behalf of runSuiteSubprocess, with
+// the commands used by the tests of failures. CMDTEST_LINE_ENDINGS sets
+// TestSuite.LineEndings.
+func TestSuiteSubprocess(t *testing.T) {
+	if os.Getenv("CMDTEST_SUBPROCESS") != "suite" {
+		t.Skip("only run by runSuiteSubprocess")
+	}
+	ts, err := Read(os.Getenv("CMDTEST_SUITE_DIR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Commands["echo-stdin"] = Program("echo-stdin")
+	ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
+	ts.Commands["echocrlf"] = func(args []string, _ string) ([]byte, error) {
+		return []byte(strings.Join(args, "\r\n") + "\r\n"), nil
+	}
+	ts.Commands["code17"] = func([]string, string) ([]byte, error) {
+		return nil, fmt.Errorf("wrapping: %w", &ExitCodeErr{Msg: "failed", Code: 17})
+	}
+	ts.Commands["inprocess99"] = InProcessProgram("inprocess99", func() int { return 99 })
+	ts.LineEndings = os.Getenv("CMDTEST_LINE_ENDINGS")
+	ts.Run(t, false)
+}
+
+func TestRunSelectedCase(t *testing.T) {
+	if os.Getenv("CMDTEST_SUBPROCESS") == "select" {
+		ts := mustReadTestSuite(t, "select")
+		ts.Run(t, false)
+		return
+	}
+	// Run this test again in a subprocess, selecting only the case named in-foo.
+	// It depends on the case before it, and the case after it fails.
+	file := regexp.QuoteMeta(filepath.Join("testdata", "select", "select"))
+	out, err := runTestSubprocess("select", "TestRunSelectedCase/"+file+"/in-foo$")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "/in-foo (") || strings.Contains(string(out), "/12 (") {
+		t.Errorf("wrong cases run:\n%s", out)
+	}
+}
+
+func TestKeepRootDirs(t *testing.T) {
+	ts := mustReadTestSuite(t, "parallel")
+	ts.KeepRootDirs = true
+	var rootDirs []string
+	ts.Setup = func(rootDir string) error {
+		rootDirs = append(rootDirs, rootDir)
+		return nil
+	}
+	ts.Run(t, false)
+	if len(rootDirs) != 2 {
+		t.Fatalf("got %d root directories, want 2", len(rootDirs))
+	}
+	for _, dir := range rootDirs {
+		if _, err := os.Stat(dir); err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKeepFailedRootDirs(t *testing.T) {
+	if os.Getenv("CMDTEST_SUBPROCESS") == "artifacts" {
+		ts := mustReadTestSuite(t, "select")
+		ts.KeepFailedRootDirs = true
+		ts.ArtifactDir = os.Getenv("CMDTEST_ARTIFACTS")
+		ts.Run(t, false)
+		return
+	}
+	// Run this test again in a subprocess, where it fails.
+	artifacts := t.TempDir()
+	out, err := runTestSubprocess("artifacts", "TestKeepFailedRootDirs", "CMDTEST_ARTIFACTS="+artifacts)
+	if err == nil {
+		t.Fatalf("got nil, want error\n%s", out)
+	}
+	m := regexp.MustCompile(`root directory kept at (\S+)`).FindSubmatch(out)
+	if m == nil {
+		t.Fatalf("root directory not logged:\n%s", out)
+	}
+	rootDir := string(m[1])
+	defer os.RemoveAll(rootDir)
+	test := filepath.Join("TestKeepFailedRootDirs", "testdata", "select", "select")
+	for _, dir := range []string{rootDir, filepath.Join(artifacts, test)} {
+		if _, err := os.Stat(filepath.Join(dir, "foo")); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestHermeticEnv(t *testing.T) {
+	defer snapshotEnv()()
+	os.Setenv("CT_KEPT", "kept")
+	os.Setenv("CT_DROPPED", "dropped")
+	ts := mustReadTestSuite(t, "hermetic")
+	ts.Env = []string{"CT_KEPT", "CT_SET=set", "CT_UNSET"}
+	ts.Setup = func(string) error {
+		if _, ok := os.LookupEnv("CT_DROPPED"); ok {
+			t.Error("CT_DROPPED is set")
+		}
+		if _, ok := os.LookupEnv("PATH"); !ok {
+			t.Error("PATH is not set")
+		}
+		return nil
+	}
+	ts.Run(t, false)
+	if got := os.Getenv("CT_DROPPED"); got != "dropped" {
+		t.Errorf("after Run, CT_DROPPED=%q, want %q", got, "dropped")
+	}
+}
+
+func TestHereString(t *testing.T) {
+	for _, test := range []struct {
+		cmd, wantBefore, wantInput string
+		wantErr                    bool
+	}{
+		{cmd: "prog <file", wantBefore: "prog <file"},
+		{cmd: "prog <<<", wantBefore: "prog", wantInput: "\n"},
+		{cmd: "prog a <<<  x  y", wantBefore: "prog a", wantInput: "x  y\n"},
+		{cmd: `prog <<< "x\x00y"`, wantBefore: "prog", wantInput: "x\x00y"},
+		{cmd: `prog <<< "x`, wantBefore: "prog", wantInput: "\"x\n"},
+		{cmd: `prog <<< "\q"`, wantErr: true},
+		{cmd: "prog <<<hex 00 ff", wantBefore: "prog", wantInput: "\x00\xff"},
+		{cmd: "prog <<<hex 0", wantErr: true},
+		{cmd: "prog <<<base64 AP8=", wantBefore: "prog", wantInput: "\x00\xff"},
+	} {
+		before, encoding, text, found := cutHereString(test.cmd)
+		var input []byte
+		var err error
+		if found {
+			input, err = decodeHereString(encoding, text)
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error: %t", test.cmd, err, test.wantErr)
+			continue
+		}
+		if err == nil && (before != test.wantBefore || string(input) != test.wantInput) {
+			t.Errorf("%q: got (%q, %q), want (%q, %q)", test.cmd, before, input, test.wantBefore, test.wantInput)
+		}
+	}
+
+	once.Do(setup)
+	ts := mustReadTestSuite(t, "herestring")
+	ts.Commands["echo-stdin"] = Program("echo-stdin")
+	ts.Commands["echoStdin"] = InProcessProgram("echoStdin", echoStdin)
+	ts.Run(t, false)
+}
+
+func TestTerminalProgram(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TerminalProgram is supported only on Linux")
+	}
+	once.Do(setup)
+	ts := mustReadTestSuite(t, "terminal")
+	ts.Commands["echo-stdin-tty"] = TerminalProgram("echo-stdin")
+	ts.Run(t, false)
+}
+
+func TestTerminalProgramTimeout(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TerminalProgram is supported only on Linux")
+	}
+	once.Do(setup)
+	defer func(d time.Duration) { ExpectTimeout = d }(ExpectTimeout)
+	ExpectTimeout = 100 * time.Millisecond
+	script := filepath.Join(t.TempDir(), "script")
+	if err := ioutil.WriteFile(script, []byte("expect Here is\nexpect nope\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := TerminalProgram("echo-stdin")(nil, script)
+	if err == nil || !strings.Contains(err.Error(), `timed out after 100ms expecting "nope"`) {
+		t.Errorf("got error %v, want timeout", err)
+	}
+	if got, want := string(out), "Here is stdin:\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	// Without a script, a command waiting for input is killed.
+	out, err = TerminalProgram("echo-stdin")(nil, "")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms waiting for the command to exit") {
+		t.Errorf("got error %v, want timeout", err)
+	}
+	if got, want := string(out), "Here is stdin:\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestTerminalScriptWithoutTerminalProgram(t *testing.T) {
+	// A command not defined with TerminalProgram reads the script as input.
+	dir := t.TempDir()
+	contents := "#expect: x\n#send: hello\n$ echo-stdin\nHere is stdin:\nexpect x\nsend hello\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.ct"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runSuiteSubprocess(dir); err != nil {
+		t.Errorf("%v\n%s", err, out)
+	}
+}
+
+func TestHTTPStub(t *testing.T) {
+	ts := mustReadTestSuite(t, "httpstub")
+	// fetch METHOD URL [BODY]
+	// send a request and write the status code and body of the response
+	ts.Commands["fetch"] = func(args []string, _ string) ([]byte, error) {
+		var body io.Reader
+		if len(args) == 3 {
+			body = strings.NewReader(args[2])
+		}
+		req, err := http.NewRequest(args[0], args[1], body)
+		if err != nil {
+			return nil, err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("%d %s\n", res.StatusCode, strings.TrimSpace(string(data)))), nil
+	}
+	ts.Run(t, false)
+	if v, ok := os.LookupEnv("HTTPSTUB"); ok {
+		t.Errorf("HTTPSTUB=%q leaked out of the test file", v)
+	}
+
+	// Outside a run, as under RunParallel, there is no state to use.
+	if _, err := httprequestsCmd(nil); err == nil || !strings.Contains(err.Error(), "not supported by RunParallel") {
+		t.Errorf("got %v, want error about RunParallel", err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	ts := mustReadTestSuite(t, "json")
+	ts.Run(t, false)
+}
+
+func TestQueryJSON(t *testing.T) {
+	v := map[string]interface{}{
+		"items": []interface{}{map[string]interface{}{"name": "a"}},
+	}
+	for _, test := range []struct {
+		query   string
+		want    interface{}
+		wantErr string
+	}{
+		{query: ".", want: v},
+		{query: ".items[0].name", want: "a"},
+		{query: ".items[0]", want: map[string]interface{}{"name": "a"}},
+		{query: "", wantErr: "empty query"},
+		{query: "items", wantErr: `want '.' or '['`},
+		{query: ".items.", wantErr: "empty key"},
+		{query: ".items[x]", wantErr: `bad index "x"`},
+		{query: ".items[0", wantErr: "missing ']'"},
+		{query: ".items[1]", wantErr: "index 1 out of range for array of length 1"},
+		{query: ".items.name", wantErr: `cannot look up key "name" in an array`},
+		{query: ".items[0].name[0]", wantErr: "cannot index a string"},
+		{query: ".other", wantErr: `no key "other"`},
+	} {
+		got, err := queryJSON(v, test.query)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%q: got error %v, want %q", test.query, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: (-want, +got)\n%s", test.query, diff)
+		}
+	}
+}
+
+func TestJSONDiff(t *testing.T) {
+	if diff := jsonDiff([]string{`{"a": 1,`, `"b": 2}`}, []string{`{"b":2,"a":1}`}); diff != "" {
+		t.Errorf("equal values: got diff\n%s", diff)
+	}
+	diff := jsonDiff([]string{`{"a": [1, 2]}`}, []string{`{"a": [1, 3]}`})
+	if !strings.Contains(diff, "float64(2)") || !strings.Contains(diff, "float64(3)") {
+		t.Errorf("different values: got diff\n%s", diff)
+	}
+	if diff := jsonDiff([]string{"1"}, []string{"{"}); !strings.HasPrefix(diff, "output is not JSON") {
+		t.Errorf("bad output: got diff\n%s", diff)
+	}
+}
+
 func TestParallel(t *testing.T) {
 	ts := mustReadTestSuite(t, "parallel")
 	ts.RunParallel(t, false)
+
+	// NAME=VALUE prefixes and capture would change the environment of the
+	// other tests.
+	for _, contents := range []string{"$ CT_A=1 echo\n", "$ capture CT_A echo x\n"} {
+		file := filepath.Join(t.TempDir(), "env.ct")
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tf, err := readFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tf.suite = &TestSuite{Commands: map[string]CommandFunc{"echo": echoCmd}}
+		r, err := tf.start(tf.cases, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.runTo(nil, noopLogger)
+		r.close()
+		if err == nil || !strings.Contains(err.Error(), "not supported by RunParallel") {
+			t.Errorf("%q: got %v, want error about RunParallel", contents, err)
+		}
+	}
 }
 
 func diffFiles(t *testing.T, gotFile, wantFile string) string {
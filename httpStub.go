@@ -0,0 +1,172 @@
+// Copyright 2026 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmdtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A stubServer is an HTTP server started by the httpstub command. It answers
+// requests from a fixed set of routes, and records them.
+type stubServer struct {
+	server *httptest.Server
+	routes map[stubRoute]stubResponse
+
+	mu       sync.Mutex
+	requests []string // formatted requests, in the order received
+}
+
+// A stubRoute is the method and path of a request that a stubServer answers.
+type stubRoute struct {
+	method, path string
+}
+
+// A stubResponse is the response that a stubServer sends for a route.
+type stubResponse struct {
+	status int
+	body   []byte
+}
+
+// httpstub ROUTES
+// start an HTTP server that answers requests as described by the file ROUTES,
+// and set HTTPSTUB to its URL
+func httpstubCmd(args []string) ([]byte, error) {
+	r, err := currentFileRun("httpstub")
+	if err != nil {
+		return nil, err
+	}
+	if r.stub != nil {
+		return nil, errors.New("httpstub: a server is already running")
+	}
+	routes, err := readStubRoutes(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s := &stubServer{routes: routes}
+	s.server = httptest.NewServer(s)
+	if err := os.Setenv("HTTPSTUB", s.server.URL); err != nil {
+		s.server.Close()
+		return nil, err
+	}
+	r.stub = s
+	r.addCapture("HTTPSTUB", s.server.URL)
+	r.cleanups = append(r.cleanups, func() {
+		s.server.Close()
+		r.stub = nil
+	})
+	return nil, nil
+}
+
+// httprequests
+// write the requests received by the httpstub server since the last httprequests
+// command
+func httprequestsCmd([]string) ([]byte, error) {
+	r, err := currentFileRun("httprequests")
+	if err != nil {
+		return nil, err
+	}
+	if r.stub == nil {
+		return nil, errors.New("httprequests: no httpstub server is running")
+	}
+	r.stub.mu.Lock()
+	defer r.stub.mu.Unlock()
+	out := []byte(strings.Join(r.stub.requests, ""))
+	r.stub.requests = nil
+	return out, nil
+}
+
+// readStubRoutes reads a routes file for the httpstub command. Each line of the
+// file has the form
+//
+//	METHOD PATH STATUS [BODYFILE]
+//
+// Empty lines and lines beginning with '#' are ignored.
+func readStubRoutes(file string) (map[stubRoute]stubResponse, error) {
+	path, err := checkPath(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	routes := map[stubRoute]stubResponse{}
+	for i, line := range splitLines(string(data)) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: want METHOD PATH STATUS [BODYFILE]", file, i+1)
+		}
+		route := stubRoute{method: fields[0], path: fields[1]}
+		if _, ok := routes[route]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate route %s %s", file, i+1, route.method, route.path)
+		}
+		var resp stubResponse
+		resp.status, err = strconv.Atoi(fields[2])
+		if err != nil || resp.status < 100 || resp.status > 999 {
+			return nil, fmt.Errorf("%s:%d: bad status %q", file, i+1, fields[2])
+		}
+		if len(fields) == 4 {
+			bodyFile, err := checkPath(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+			}
+			if resp.body, err = ioutil.ReadFile(bodyFile); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, i+1, err)
+			}
+		}
+		routes[route] = resp
+	}
+	return routes, nil
+}
+
+// ServeHTTP records the request and answers it from s's routes, or with status
+// 404 if no route matches.
+func (s *stubServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", req.Method, req.URL.RequestURI())
+	// Prefix the lines of the body so that empty lines do not end the output of
+	// a case.
+	for _, line := range splitLines(string(body)) {
+		fmt.Fprintln(&buf, strings.TrimRight("| "+line, " "))
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, buf.String())
+	s.mu.Unlock()
+
+	resp, ok := s.routes[stubRoute{method: req.Method, path: req.URL.Path}]
+	if !ok {
+		http.Error(w, fmt.Sprintf("httpstub: no route for %s %s", req.Method, req.URL.Path), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
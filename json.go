@@ -0,0 +1,173 @@
+// Copyright 2026 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmdtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// json FILE [QUERY]
+// write the single JSON value in FILE, or the part of it selected by QUERY, indented
+// and with sorted object keys
+func jsonCmd(args []string) ([]byte, error) {
+	if len(args) > 2 {
+		return nil, errors.New("need at most 2 arguments")
+	}
+	file, err := checkPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // preserve the formatting of numbers
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("%s: %v", args[0], err)
+	}
+	if err := dec.Decode(new(interface{})); err != io.EOF {
+		return nil, fmt.Errorf("%s: unexpected data after JSON value", args[0])
+	}
+	if len(args) == 2 {
+		if v, err = queryJSON(v, args[1]); err != nil {
+			return nil, fmt.Errorf("%s: %v", args[0], err)
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// queryJSON returns the part of v, a decoded JSON value, selected by query. A
+// query is a sequence of object keys, each preceded by '.', and array indexes in
+// square brackets, as in ".items[0].name". The query "." selects all of v.
+func queryJSON(v interface{}, query string) (interface{}, error) {
+	if query == "." {
+		return v, nil
+	}
+	if query == "" {
+		return nil, errors.New("empty query")
+	}
+	q := query
+	for q != "" {
+		switch q[0] {
+		case '.':
+			i := strings.IndexAny(q[1:], ".[") + 1
+			if i == 0 {
+				i = len(q)
+			}
+			key := q[1:i]
+			if key == "" {
+				return nil, fmt.Errorf("bad query %q: empty key", query)
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("query %q: cannot look up key %q in %s", query, key, jsonKind(v))
+			}
+			if v, ok = m[key]; !ok {
+				return nil, fmt.Errorf("query %q: no key %q", query, key)
+			}
+			q = q[i:]
+		case '[':
+			i := strings.IndexByte(q, ']')
+			if i < 0 {
+				return nil, fmt.Errorf("bad query %q: missing ']'", query)
+			}
+			n, err := strconv.Atoi(q[1:i])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad query %q: bad index %q", query, q[1:i])
+			}
+			a, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("query %q: cannot index %s", query, jsonKind(v))
+			}
+			if n >= len(a) {
+				return nil, fmt.Errorf("query %q: index %d out of range for array of length %d", query, n, len(a))
+			}
+			v = a[n]
+			q = q[i+1:]
+		default:
+			return nil, fmt.Errorf("bad query %q: want '.' or '[' at %q", query, q)
+		}
+	}
+	return v, nil
+}
+
+// jsonKind describes the kind of v, a decoded JSON value, for error messages.
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case json.Number, float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	default:
+		return "null"
+	}
+}
+
+// jsonDiff compares want and got, the lines of the expected and actual output of
+// a case, as sequences of JSON values, ignoring white space and the order of
+// object keys. It returns a description of the differences, or the empty string
+// if there are none.
+func jsonDiff(want, got []string) string {
+	wantVals, err := decodeJSONValues(want)
+	if err != nil {
+		return fmt.Sprintf("expected output is not JSON: %v\n", err)
+	}
+	gotVals, err := decodeJSONValues(got)
+	if err != nil {
+		return fmt.Sprintf("output is not JSON: %v\n%s", err, cmp.Diff(want, got))
+	}
+	return cmp.Diff(wantVals, gotVals)
+}
+
+// decodeJSONValues decodes the sequence of JSON values in lines.
+func decodeJSONValues(lines []string) ([]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(strings.Join(lines, "\n")))
+	var vals []interface{}
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+}